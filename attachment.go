@@ -0,0 +1,339 @@
+package mailreader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Attachment describes a file attached to a message.
+type Attachment struct {
+	// Path locates the part in the MIME tree, see MimePart.
+	Path     string `json:"path"`
+	Filename string `json:"filename,omitempty"`
+	MimeType string `json:"mime_type"`
+	// Size is the decoded size in octets.
+	Size      int64  `json:"size"`
+	ContentID string `json:"content_id,omitempty"`
+	// Inline is set for parts meant to be shown within the body, the images
+	// of an HTML message mostly.
+	Inline bool `json:"inline"`
+	// SHA256 is the hex encoded digest of the decoded content.
+	SHA256 string `json:"sha256"`
+	// File is where a DirSink saved the content.
+	File string `json:"file,omitempty"`
+}
+
+// IsAttachment reports whether p holds a file rather than a body of the
+// message.
+func (p *MimePart) IsAttachment() bool {
+	if len(p.Children) > 0 || p.IsMultipart() {
+		return false
+	}
+	if p.Disposition == "attachment" || p.Filename != "" {
+		return true
+	}
+	return !strings.HasPrefix(p.ContentType, "text/")
+}
+
+// Attachments describes the attachments of the tree, Content holding their
+// bodies.
+func (p *MimePart) Attachments() []Attachment {
+	var atts []Attachment
+	for _, l := range p.Leaves() {
+		if !l.IsAttachment() {
+			continue
+		}
+
+		a := newAttachment(l)
+		sum := sha256.Sum256([]byte(l.Content))
+		a.Size = int64(len(l.Content))
+		a.SHA256 = hex.EncodeToString(sum[:])
+		atts = append(atts, a)
+	}
+	return atts
+}
+
+// newAttachment describes p, but for its size and digest.
+func newAttachment(p *MimePart) Attachment {
+	a := Attachment{
+		Path:      p.Path,
+		Filename:  p.Filename,
+		MimeType:  p.ContentType,
+		ContentID: strings.Trim(p.Header.Get("Content-Id"), "<> \t"),
+	}
+	a.Inline = p.Disposition == "inline" || p.Disposition == "" && a.ContentID != ""
+	return a
+}
+
+// AttachmentFilter selects attachments. A nil filter keeps them all.
+type AttachmentFilter struct {
+	// MimeTypes lists the types to keep, "image/*" keeps a whole family.
+	MimeTypes []string
+	// MinSize and MaxSize bound the decoded size. MaxSize is ignored when
+	// zero.
+	MinSize int64
+	MaxSize int64
+	// SkipInline drops the inline parts.
+	SkipInline bool
+}
+
+// Match reports whether the filter keeps a, once its size is known.
+func (f *AttachmentFilter) Match(a *Attachment) bool {
+	if f == nil {
+		return true
+	}
+	return f.matchType(a) && a.Size >= f.MinSize && (f.MaxSize == 0 || a.Size <= f.MaxSize)
+}
+
+// matchType checks what is known of a before its body is read.
+func (f *AttachmentFilter) matchType(a *Attachment) bool {
+	if f == nil {
+		return true
+	}
+	if f.SkipInline && a.Inline {
+		return false
+	}
+	if len(f.MimeTypes) == 0 {
+		return true
+	}
+
+	for _, t := range f.MimeTypes {
+		t = strings.ToLower(t)
+		if t == a.MimeType {
+			return true
+		}
+		if family, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(a.MimeType, family+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *AttachmentFilter) maxSize() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.MaxSize
+}
+
+// errAttachmentFiltered tells a sink the body it got is not wanted.
+var errAttachmentFiltered = errors.New("attachment filtered out")
+
+// AttachmentSink receives the attachment bodies StreamAttachments reads.
+type AttachmentSink interface {
+	// Create returns the writer the body of a is streamed to. Its size and
+	// digest are not known yet.
+	Create(a *Attachment) (io.Writer, error)
+	// Close ends the body of a. err is set when the body is rejected by the
+	// filter or could not be read, the sink then drops what it got.
+	Close(a *Attachment, err error) error
+}
+
+// StreamAttachments reads the raw message msg and streams the bodies of the
+// attachments the filter keeps to sink, one at a time, without holding
+// them in memory. DefaultLimits apply, the error is the limit broken when
+// one cut the message short.
+func StreamAttachments(msg io.Reader, filter *AttachmentFilter, sink AttachmentSink) ([]Attachment, error) {
+	return streamAttachments(msg, filter, sink, DefaultLimits)
+}
+
+func streamAttachments(msg io.Reader, filter *AttachmentFilter, sink AttachmentSink, limits Limits) ([]Attachment, error) {
+	limits = limits.withDefaults()
+	m, err := readMessage(msg, limits.MaxHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var atts []Attachment
+	w := &mimeWalker{limits: limits, leaf: func(p *MimePart, body io.Reader) error {
+		if wantAttachment(p, filter) {
+			a, err := sinkAttachment(p, body, filter, sink)
+			if err != nil {
+				return err
+			}
+			if a != nil {
+				atts = append(atts, *a)
+			}
+		}
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}}
+
+	if _, err := w.parse(m); err != nil {
+		return atts, err
+	}
+	return atts, w.truncated
+}
+
+// wantAttachment reports whether p is an attachment the filter may keep,
+// before its body is read.
+func wantAttachment(p *MimePart, filter *AttachmentFilter) bool {
+	a := newAttachment(p)
+	return p.IsAttachment() && filter.matchType(&a)
+}
+
+// sinkAttachment streams body, the content of the attachment p, to sink.
+// It returns nil when the filter drops the attachment once its size is
+// known, the sink being told so.
+func sinkAttachment(p *MimePart, body io.Reader, filter *AttachmentFilter, sink AttachmentSink) (*Attachment, error) {
+	a := newAttachment(p)
+	dst, err := sink.Create(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	err = copyAttachment(&a, dst, body, filter.maxSize())
+	if err == nil && !filter.Match(&a) {
+		err = errAttachmentFiltered
+	}
+	if cerr := sink.Close(&a, err); cerr != nil {
+		return nil, cerr
+	}
+
+	switch {
+	case errors.Is(err, errAttachmentFiltered):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("attachment %v: %w", a.Path, err)
+	}
+	return &a, nil
+}
+
+// WriteAttachment reads the raw message msg and streams the body of the
+// part at path to w.
+func WriteAttachment(msg io.Reader, path string, w io.Writer) (*Attachment, error) {
+	limits := DefaultLimits.withDefaults()
+	m, err := readMessage(msg, limits.MaxHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Attachment
+	walker := &mimeWalker{limits: limits, leaf: func(p *MimePart, body io.Reader) error {
+		if p.Path != path || found != nil {
+			_, err := io.Copy(io.Discard, body)
+			return err
+		}
+
+		a := newAttachment(p)
+		found = &a
+		return copyAttachment(found, w, body, 0)
+	}}
+
+	if _, err := walker.parse(m); err != nil {
+		return found, err
+	}
+	if found == nil {
+		return nil, ErrAttachmentNotFound
+	}
+	return found, nil
+}
+
+// copyAttachment copies body to dst, setting the size and digest of a. It
+// stops with errAttachmentFiltered past max octets, when max is set.
+func copyAttachment(a *Attachment, dst io.Writer, body io.Reader, max int64) error {
+	if max > 0 {
+		body = io.LimitReader(body, max+1)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), body)
+	a.Size = n
+	a.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if max > 0 && n > max {
+		return errAttachmentFiltered
+	}
+	return nil
+}
+
+// DirSink saves attachments as files of the directory Dir, created when
+// missing. Names are cleaned of path elements and made unique.
+type DirSink struct {
+	Dir   string
+	files map[string]*os.File
+}
+
+func (s *DirSink) Create(a *Attachment) (io.Writer, error) {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := safeFilename(a)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			name = fmt.Sprintf("%v (%d)%v", base, i, ext)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if s.files == nil {
+			s.files = make(map[string]*os.File)
+		}
+		s.files[a.Path] = f
+		return f, nil
+	}
+}
+
+func (s *DirSink) Close(a *Attachment, err error) error {
+	f := s.files[a.Path]
+	delete(s.files, a.Path)
+	if f == nil {
+		return nil
+	}
+
+	cerr := f.Close()
+	if err != nil {
+		return os.Remove(f.Name())
+	}
+	if cerr != nil {
+		os.Remove(f.Name())
+		return cerr
+	}
+
+	a.File = f.Name()
+	return nil
+}
+
+// safeFilename returns a file name for a that cannot escape a directory.
+func safeFilename(a *Attachment) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, a.Filename)
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	if name == "" || name == "/" {
+		name = "attachment-" + strings.ReplaceAll(a.Path, ".", "-")
+		if exts, _ := mime.ExtensionsByType(a.MimeType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	if len(name) > 200 {
+		ext := filepath.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:200-len(ext)], "") + ext
+	}
+	return name
+}
@@ -0,0 +1,149 @@
+package mailreader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// decodeTransfer undoes the Content-Transfer-Encoding enc of b.
+func decodeTransfer(enc string, b []byte) ([]byte, error) {
+	return io.ReadAll(transferReader(enc, bytes.NewReader(b)))
+}
+
+// transferReader decodes the Content-Transfer-Encoding enc of r as it is
+// read. Unknown encodings, 7bit, 8bit and binary are read as is.
+func transferReader(enc string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "base64":
+		return base64.NewDecoder(base64.RawStdEncoding, &base64Filter{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// base64Filter is lenient with what mailers send: it drops line breaks
+// and stray characters, stops at the padding and drops a lone trailing
+// character, which carries no full byte.
+type base64Filter struct {
+	r   io.Reader
+	buf []byte
+	// n counts the characters kept, the last one being held back
+	n    int
+	held byte
+	done bool
+}
+
+func (f *base64Filter) Read(p []byte) (int, error) {
+	for {
+		if f.done {
+			// the last character is released once the length is known
+			if f.n > 0 && f.n%4 != 1 && len(p) > 0 {
+				p[0] = f.held
+				f.n = 0
+				return 1, nil
+			}
+			return 0, io.EOF
+		}
+
+		if cap(f.buf) == 0 {
+			f.buf = make([]byte, 4096)
+		}
+		k, err := f.r.Read(f.buf[:min(len(p), cap(f.buf))])
+
+		out := p[:0]
+		for _, c := range f.buf[:k] {
+			switch {
+			case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '+', c == '/':
+				if f.n > 0 {
+					out = append(out, f.held)
+				}
+				f.held = c
+				f.n++
+			case c == '=':
+				// padding ends the data
+				f.done = true
+			}
+			if f.done {
+				break
+			}
+		}
+		if err == io.EOF {
+			f.done = true
+		} else if err != nil {
+			return len(out), err
+		}
+
+		if len(out) > 0 {
+			return len(out), nil
+		}
+	}
+}
+
+// charsetAliases maps labels seen in the wild to ones the WHATWG index
+// knows.
+var charsetAliases = map[string]string{
+	"cp1250":  "windows-1250",
+	"cp1251":  "windows-1251",
+	"cp1252":  "windows-1252",
+	"cp1253":  "windows-1253",
+	"cp1254":  "windows-1254",
+	"cp1255":  "windows-1255",
+	"cp1256":  "windows-1256",
+	"cp1257":  "windows-1257",
+	"cp1258":  "windows-1258",
+	"cp932":   "shift_jis",
+	"cp936":   "gbk",
+	"cp949":   "euc-kr",
+	"cp950":   "big5",
+	"ansi":    "windows-1252",
+	"ascii":   "us-ascii",
+	"utf-8y":  "utf-8",
+	"x-gbk":   "gbk",
+	"ms936":   "gbk",
+	"sjis":    "shift_jis",
+	"x-sjis":  "shift_jis",
+	"koi8r":   "koi8-r",
+	"latin-1": "iso-8859-1",
+}
+
+// lookupCharset returns the encoding of the charset label, nil when it is
+// unknown.
+func lookupCharset(label string) encoding.Encoding {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if alias, ok := charsetAliases[label]; ok {
+		label = alias
+	}
+
+	e, err := htmlindex.Get(label)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// toUTF8 converts b from charset to UTF-8. Text in an unknown charset, or
+// that fails to convert, is returned unchanged.
+func toUTF8(charset string, b []byte) []byte {
+	if charset == "" {
+		return b
+	}
+
+	e := lookupCharset(charset)
+	if e == nil || e == encoding.Nop {
+		return b
+	}
+
+	out, _, err := transform.Bytes(e.NewDecoder(), b)
+	if err != nil {
+		return b
+	}
+	return out
+}
@@ -5,11 +5,9 @@ go 1.22.3
 require (
 	github.com/denisss025/go-pop3-client v0.0.0-20190319130039-5d933712d223
 	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20231106173351-e73c9f7bad43
 	golang.org/x/net v0.27.0
+	golang.org/x/text v0.16.0
 )
 
-require (
-	github.com/emersion/go-sasl v0.0.0-20231106173351-e73c9f7bad43 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
-	golang.org/x/text v0.16.0 // indirect
-)
+require github.com/stretchr/testify v1.9.0 // indirect
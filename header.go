@@ -0,0 +1,193 @@
+package mailreader
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset the WHATWG
+// index knows. Words in an unknown charset keep their bytes.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// addressParser parses address lists with headerDecoder.
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+// encodedWordRe matches the encoded words the strict decoder leaves alone,
+// spaces or bad padding in the encoded text for instance.
+var encodedWordRe = regexp.MustCompile(`=\?([^?\s]+)\?([bBqQ])\?(.*?)\?=`)
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	// RFC 2231 adds a language to the charset of encoded words
+	charset, _, _ = strings.Cut(charset, "*")
+
+	e := lookupCharset(charset)
+	if e == nil {
+		return input, nil
+	}
+	return transform.NewReader(input, e.NewDecoder()), nil
+}
+
+// decodeHeader decodes the encoded words of the header value v. Raw 8 bit
+// values, which should not exist but do, are read in the fallback charset,
+// usually the one of the message body. The result is always valid UTF-8.
+func decodeHeader(v, fallback string) string {
+	if !utf8.ValidString(v) {
+		v = string(toUTF8(fallback, []byte(v)))
+	}
+
+	if d, err := headerDecoder.DecodeHeader(v); err == nil {
+		v = d
+	}
+	if strings.Contains(v, "=?") {
+		v = encodedWordRe.ReplaceAllStringFunc(v, decodeBrokenWord)
+	}
+
+	return strings.ToValidUTF8(v, "\uFFFD")
+}
+
+// decodeBrokenWord decodes an encoded word as best it can.
+func decodeBrokenWord(word string) string {
+	m := encodedWordRe.FindStringSubmatch(word)
+	charset, _, _ := strings.Cut(m[1], "*")
+
+	var b []byte
+	if strings.EqualFold(m[2], "b") {
+		var err error
+		if b, err = decodeTransfer("base64", []byte(m[3])); err != nil {
+			return word
+		}
+	} else {
+		b = decodeQ(m[3])
+	}
+
+	return string(toUTF8(charset, b))
+}
+
+// decodeQ decodes the Q encoding, keeping invalid escapes as they are.
+func decodeQ(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '_':
+			b = append(b, ' ')
+		case c == '=' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b = append(b, byte(n))
+			i += 2
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// contentCharset returns the charset of the Content-Type of h.
+func contentCharset(h mail.Header) string {
+	_, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return params["charset"]
+}
+
+// mimeFilename returns the decoded file name of p, from the disposition
+// filename or the content type name. Both RFC 2231 and RFC 2047, which
+// many mailers use instead, are understood.
+func mimeFilename(p *MimePart) string {
+	for _, c := range []struct {
+		header, key string
+		params      map[string]string
+	}{
+		{"Content-Disposition", "filename", p.DispositionParams},
+		{"Content-Type", "name", p.Params},
+	} {
+		// the standard parser only knows UTF-8 extended values, and keeps
+		// the continuations of the others undecoded
+		if v := extendedParam(p.Header.Get(c.header), c.key); v != "" {
+			return v
+		}
+		if v := c.params[c.key]; v != "" {
+			return decodeHeader(v, p.Charset)
+		}
+	}
+	return ""
+}
+
+// extendedParam decodes the RFC 2231 parameter key of the header value v,
+// in any charset and possibly split in continuations.
+func extendedParam(v, key string) string {
+	type section struct {
+		n       int
+		encoded bool
+		value   string
+	}
+
+	var sections []section
+	for _, param := range strings.Split(v, ";") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// key*, key*N or key*N*
+		rest, ok := strings.CutPrefix(name, key+"*")
+		if !ok {
+			continue
+		}
+		s := section{value: strings.Trim(strings.TrimSpace(value), `"`)}
+		if rest == "" {
+			s.encoded = true
+		} else {
+			rest, s.encoded = strings.CutSuffix(rest, "*")
+			n, err := strconv.Atoi(rest)
+			if err != nil {
+				continue
+			}
+			s.n = n
+		}
+		sections = append(sections, s)
+	}
+	if len(sections) == 0 {
+		return ""
+	}
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].n < sections[j].n })
+
+	// the first section names the charset of all the encoded ones
+	var charset string
+	if sections[0].encoded {
+		parts := strings.SplitN(sections[0].value, "'", 3)
+		if len(parts) != 3 {
+			return ""
+		}
+		charset, sections[0].value = parts[0], parts[2]
+	}
+
+	var b []byte
+	for _, s := range sections {
+		if !s.encoded {
+			b = append(b, s.value...)
+			continue
+		}
+		u, err := url.PathUnescape(s.value)
+		if err != nil {
+			u = s.value
+		}
+		b = append(b, u...)
+	}
+
+	return strings.ToValidUTF8(string(toUTF8(charset, b)), "\uFFFD")
+}
@@ -0,0 +1,106 @@
+package mailreader
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		fallback string
+		want     string
+	}{
+		{"plain", "Hello world", "", "Hello world"},
+		{"base64", "=?UTF-8?B?SGVsbG8gV8O2cmxk?=", "", "Hello Wörld"},
+		{"q latin1", "=?ISO-8859-1?Q?caf=E9_cr=E8me?=", "", "café crème"},
+		{"adjacent words", "=?UTF-8?Q?a?= =?UTF-8?Q?b?=", "", "ab"},
+		{"text around", "Re: =?UTF-8?Q?h=C3=A9?= there", "", "Re: hé there"},
+		{"windows-1251", "=?windows-1251?B?z/Do4uXy?=", "", "Привет"},
+		{"charset alias", "=?cp1251?B?z/Do4uXy?=", "", "Привет"},
+		{"lowercase encoding", "=?utf-8?q?caf=C3=A9?=", "", "café"},
+		{"language suffix", "=?UTF-8*en?Q?hi?=", "", "hi"},
+		{"base64 without padding", "=?UTF-8?B?SGVsbG8?=", "", "Hello"},
+		{"base64 with junk", "=?UTF-8?B?SGVs bG8=?=", "", "Hello"},
+		{"space in q word", "=?UTF-8?Q?two words?=", "", "two words"},
+		{"raw latin1", "caf\xe9", "iso-8859-1", "café"},
+		{"raw windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "windows-1251", "Привет"},
+		{"raw without fallback", "caf\xe9", "", "caf�"},
+		{"iso-2022-jp", "=?ISO-2022-JP?B?GyRCJEskTyQ3JEEkTxsoQg==?=", "", "にはしちは"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeHeader(tt.in, tt.fallback); got != tt.want {
+				t.Errorf("decodeHeader(%q, %q) = %q, want %q", tt.in, tt.fallback, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMimeFilename(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "disposition",
+			header: "Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"report.pdf\"",
+			want:   "report.pdf",
+		},
+		{
+			name:   "content type name",
+			header: "Content-Type: application/pdf; name=\"report.pdf\"",
+			want:   "report.pdf",
+		},
+		{
+			name:   "disposition first",
+			header: "Content-Type: application/pdf; name=\"b.pdf\"\r\nContent-Disposition: attachment; filename=\"a.pdf\"",
+			want:   "a.pdf",
+		},
+		{
+			name:   "rfc 2047",
+			header: "Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"=?UTF-8?B?0L7RgtGH0ZHRgi5wZGY=?=\"",
+			want:   "отчёт.pdf",
+		},
+		{
+			name:   "rfc 2231 utf-8",
+			header: "Content-Type: application/pdf\r\nContent-Disposition: attachment; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf",
+			want:   "отчёт.pdf",
+		},
+		{
+			name:   "rfc 2231 latin1",
+			header: "Content-Type: application/pdf\r\nContent-Disposition: attachment; filename*=iso-8859-1'fr'caf%E9.pdf",
+			want:   "café.pdf",
+		},
+		{
+			name:   "rfc 2231 continuations",
+			header: "Content-Type: application/pdf\r\nContent-Disposition: attachment;\r\n filename*0*=windows-1251''%EE%F2;\r\n filename*1*=%F7%E5%F2;\r\n filename*2=\".pdf\"",
+			want:   "отчет.pdf",
+		},
+		{
+			name:   "none",
+			header: "Content-Type: application/pdf",
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := mail.ReadMessage(strings.NewReader(tt.header + "\r\n\r\nbody"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := ParseMimeTree(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree.Filename != tt.want {
+				t.Errorf("Filename = %q, want %q", tree.Filename, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package mailreader
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLTextOptions tunes HTMLToText.
+type HTMLTextOptions struct {
+	// InlineLinks writes link targets after their text, "text <url>",
+	// instead of numbered footnotes listed at the end.
+	InlineLinks bool
+}
+
+// HTMLToText renders an HTML body as readable plain text. Paragraphs,
+// lists, quotes and tables keep their layout, links become footnotes.
+// Scripts, styles, hidden elements and tracking pixels are dropped.
+func HTMLToText(s string, opts HTMLTextOptions) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return strings.TrimSpace(s)
+	}
+
+	r := newTextRenderer(opts, &footnotes{})
+	r.node(doc)
+	out := r.String()
+
+	if len(r.links.urls) > 0 {
+		var b strings.Builder
+		b.WriteString(out)
+		b.WriteString("\n\n")
+		for i, l := range r.links.urls {
+			fmt.Fprintf(&b, "[%d] %v\n", i+1, l)
+		}
+		out = strings.TrimSpace(b.String())
+	}
+	return out
+}
+
+// textRenderer writes the text of HTML nodes, managing whitespace and
+// line prefixes.
+type textRenderer struct {
+	opts HTMLTextOptions
+	b    strings.Builder
+	// links collects the footnotes, shared with the renderers of table
+	// cells
+	links *footnotes
+
+	// breaks is the number of line breaks owed before the next text,
+	// breakDepth the number of prefixes their blank lines carry
+	breaks     int
+	breakDepth int
+	space      bool
+	// lineStart is set when the prefix of the line has not been written
+	lineStart bool
+	// glue keeps what follows a list marker on its line
+	glue   bool
+	prefix []string
+	pre    int
+	lists  int
+}
+
+func newTextRenderer(opts HTMLTextOptions, links *footnotes) *textRenderer {
+	return &textRenderer{opts: opts, links: links, lineStart: true}
+}
+
+// footnotes numbers the link targets, from 1, each one once.
+type footnotes struct {
+	urls  []string
+	index map[string]int
+}
+
+// add returns the number of the footnote of url, adding it when new.
+func (f *footnotes) add(url string) int {
+	if i, ok := f.index[url]; ok {
+		return i
+	}
+	if f.index == nil {
+		f.index = make(map[string]int)
+	}
+	f.urls = append(f.urls, url)
+	f.index[url] = len(f.urls)
+	return len(f.urls)
+}
+
+var (
+	// zeroWidthRe matches the invisible characters padding preheaders.
+	zeroWidthRe = regexp.MustCompile("[\u00ad\u034f\u180e\u200b-\u200d\u2060\ufeff]")
+	spaceRe     = regexp.MustCompile(`[ \t\r\n\f\x{a0}]+`)
+	blankRe     = regexp.MustCompile(`\n{3,}`)
+)
+
+func (r *textRenderer) String() string {
+	lines := strings.Split(r.b.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.TrimSpace(blankRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// block asks for n line breaks, a blank line for two, before what follows.
+func (r *textRenderer) block(n int) {
+	if r.glue {
+		return
+	}
+	if r.b.Len() > 0 && n > r.breaks {
+		r.breaks = n
+	}
+	r.breakDepth = min(r.breakDepth, len(r.prefix))
+	r.space = false
+}
+
+// write writes text, whitespace already collapsed.
+func (r *textRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+
+	if r.breaks > 0 {
+		for ; r.breaks > 0; r.breaks-- {
+			r.newline()
+		}
+		r.space = false
+	}
+	r.breakDepth = len(r.prefix)
+	if r.lineStart {
+		r.b.WriteString(strings.Join(r.prefix, ""))
+		r.lineStart = false
+	} else if r.space {
+		r.b.WriteByte(' ')
+	}
+	r.space = false
+	r.glue = false
+	r.b.WriteString(s)
+}
+
+// writeLines writes text keeping its line breaks.
+func (r *textRenderer) writeLines(s string) {
+	for i, l := range strings.Split(s, "\n") {
+		if i > 0 {
+			r.breaks++
+		}
+		r.write(l)
+	}
+}
+
+func (r *textRenderer) newline() {
+	if r.lineStart {
+		// keep the prefix of empty lines within a quote
+		r.b.WriteString(strings.TrimRight(strings.Join(r.prefix[:min(r.breakDepth, len(r.prefix))], ""), " "))
+	}
+	r.b.WriteByte('\n')
+	r.lineStart = true
+}
+
+func (r *textRenderer) text(s string) {
+	s = zeroWidthRe.ReplaceAllString(s, "")
+	if r.pre > 0 {
+		r.writeLines(strings.ReplaceAll(s, "\u00a0", " "))
+		return
+	}
+
+	words := spaceRe.ReplaceAllString(s, " ")
+	if strings.HasPrefix(words, " ") {
+		r.space = true
+	}
+	trimmed := strings.TrimSpace(words)
+	r.write(trimmed)
+	if trimmed != "" && strings.HasSuffix(words, " ") {
+		r.space = true
+	}
+}
+
+func (r *textRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.node(c)
+	}
+}
+
+func (r *textRenderer) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	if hiddenElement(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Title,
+		atom.Iframe, atom.Object, atom.Embed, atom.Svg, atom.Button, atom.Select:
+		return
+
+	case atom.Br:
+		r.breaks++
+		r.space = false
+
+	case atom.Hr:
+		r.block(2)
+		r.write("---")
+		r.block(2)
+
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Dl:
+		// paragraphs of list items stay tight
+		breaks := 2
+		if r.lists > 0 {
+			breaks = 1
+		}
+		r.block(breaks)
+		r.children(n)
+		r.block(breaks)
+
+	case atom.Pre:
+		r.block(2)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.block(2)
+
+	case atom.Blockquote:
+		r.block(2)
+		r.prefix = append(r.prefix, "> ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.block(2)
+
+	case atom.Ul, atom.Ol:
+		r.list(n)
+
+	case atom.Li:
+		// outside of a list
+		r.block(1)
+		r.write("- ")
+		r.children(n)
+		r.block(1)
+
+	case atom.Dd:
+		r.block(1)
+		r.prefix = append(r.prefix, "  ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.block(1)
+
+	case atom.Table:
+		r.table(n)
+
+	case atom.A:
+		r.link(n)
+
+	case atom.Img:
+		if !trackingPixel(n) {
+			r.text(attr(n, "alt"))
+		}
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Aside,
+		atom.Main, atom.Address, atom.Center, atom.Form, atom.Fieldset, atom.Figure, atom.Figcaption,
+		atom.Dt, atom.Tr, atom.Caption, atom.Details, atom.Summary:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+
+	default:
+		r.children(n)
+	}
+}
+
+func (r *textRenderer) list(n *html.Node) {
+	// nested lists go on with their parent item
+	breaks := 2
+	if r.lists > 0 {
+		breaks = 1
+	}
+	r.lists++
+	defer func() { r.lists-- }()
+	r.block(breaks)
+
+	i := 1
+	if n.DataAtom == atom.Ol {
+		if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+			i = start
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			r.node(c)
+			continue
+		}
+
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", i)
+			i++
+		}
+
+		r.block(1)
+		r.write(marker)
+		r.glue = true
+		// continuation lines line up with the text of the item
+		r.prefix = append(r.prefix, strings.Repeat(" ", len(marker)))
+		r.children(c)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+	}
+
+	r.block(breaks)
+}
+
+// table writes a row per line, the cells of a row joined by " | ". Rows of
+// cells spanning several lines, layout tables mostly, are written as
+// blocks.
+func (r *textRenderer) table(n *html.Node) {
+	r.block(1)
+
+	for _, row := range tableRows(n) {
+		var cells []string
+		multiline := false
+		for _, cell := range row {
+			sub := newTextRenderer(r.opts, r.links)
+			sub.children(cell)
+			if s := sub.String(); s != "" {
+				cells = append(cells, s)
+				multiline = multiline || strings.Contains(s, "\n")
+			}
+		}
+		if len(cells) == 0 {
+			continue
+		}
+
+		if multiline {
+			for _, c := range cells {
+				r.block(1)
+				r.writeLines(c)
+				r.block(1)
+			}
+			continue
+		}
+
+		r.block(1)
+		r.write(strings.Join(cells, " | "))
+		r.block(1)
+	}
+
+	r.block(1)
+}
+
+// tableRows returns the cells of the rows of table t, nested tables left
+// to the cells holding them.
+func tableRows(t *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				walk(c)
+			case atom.Tr:
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) && !hiddenElement(cell) {
+						cells = append(cells, cell)
+					}
+				}
+				rows = append(rows, cells)
+			}
+		}
+	}
+	walk(t)
+	return rows
+}
+
+func (r *textRenderer) link(n *html.Node) {
+	sub := newTextRenderer(r.opts, r.links)
+	sub.children(n)
+	text := strings.Join(strings.Fields(sub.String()), " ")
+
+	href := strings.TrimSpace(attr(n, "href"))
+	lower := strings.ToLower(href)
+	if href == "" || strings.HasPrefix(lower, "#") || strings.HasPrefix(lower, "javascript:") ||
+		text == href || "mailto:"+text == href {
+		r.text(text)
+		return
+	}
+
+	r.text(text)
+	if r.opts.InlineLinks {
+		r.space = text != ""
+		r.write("<" + href + ">")
+		return
+	}
+
+	i := r.links.add(href)
+	if text != "" {
+		r.space = false
+	}
+	r.write(fmt.Sprintf("[%d]", i))
+}
+
+// hiddenElement reports whether n is not displayed, like the preheaders
+// newsletters hide with their styles.
+func hiddenElement(n *html.Node) bool {
+	if _, ok := attrOk(n, "hidden"); ok {
+		return true
+	}
+
+	style := strings.ToLower(strings.ReplaceAll(attr(n, "style"), " ", ""))
+	return strings.Contains(style, "display:none") ||
+		strings.Contains(style, "visibility:hidden") ||
+		strings.Contains(style, "mso-hide:all")
+}
+
+// trackingPixel reports whether the image n is a tracking pixel rather
+// than something to look at.
+func trackingPixel(n *html.Node) bool {
+	tiny := func(v string) bool {
+		v = strings.TrimSuffix(strings.TrimSpace(v), "px")
+		size, err := strconv.ParseFloat(v, 64)
+		return err == nil && size <= 1
+	}
+	if tiny(attr(n, "width")) || tiny(attr(n, "height")) {
+		return true
+	}
+
+	for _, decl := range strings.Split(strings.ToLower(attr(n, "style")), ";") {
+		prop, value, _ := strings.Cut(decl, ":")
+		switch strings.TrimSpace(prop) {
+		case "width", "height", "max-width", "max-height":
+			if tiny(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	v, _ := attrOk(n, key)
+	return v
+}
+
+func attrOk(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && strings.EqualFold(a.Key, key) {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// bestText picks the text to show for a message: the first non empty
+// text/plain part, or the first text/html part rendered as text.
+func bestText(contentTypes, contents []string) string {
+	var htmlBody string
+	found := false
+	for i, ct := range contentTypes {
+		mediaType, _, _ := mime.ParseMediaType(ct)
+		switch mediaType {
+		case "text/plain", "":
+			if s := strings.TrimSpace(contents[i]); s != "" {
+				return s
+			}
+		case "text/html":
+			if !found {
+				htmlBody, found = contents[i], true
+			}
+		}
+	}
+
+	if !found {
+		return ""
+	}
+	return HTMLToText(htmlBody, HTMLTextOptions{})
+}
+
+// TextBody returns the best plain text body of the message, its HTML body
+// rendered as text when it has no plain text one.
+func (m *ImapMail) TextBody() string {
+	types := make([]string, len(m.Parts))
+	contents := make([]string, len(m.Parts))
+	for i, p := range m.Parts {
+		types[i], contents[i] = p.ContentType, p.Content
+	}
+	return bestText(types, contents)
+}
+
+// TextBody returns the best plain text body of the message, its HTML body
+// rendered as text when it has no plain text one.
+func (m *Pop3Mail) TextBody() string {
+	types := make([]string, len(m.Parts))
+	contents := make([]string, len(m.Parts))
+	for i, p := range m.Parts {
+		types[i], contents[i] = p.ContentType, p.Content
+	}
+	return bestText(types, contents)
+}
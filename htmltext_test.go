@@ -0,0 +1,132 @@
+package mailreader
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name   string
+		html   string
+		inline bool
+		want   string
+	}{
+		{
+			name: "paragraphs",
+			html: "<p>First   paragraph\nwrapped.</p><p>Second</p>",
+			want: "First paragraph wrapped.\n\nSecond",
+		},
+		{
+			name: "line breaks",
+			html: "<div>one<br>two<br><br>three</div>",
+			want: "one\ntwo\n\nthree",
+		},
+		{
+			name: "headings and rules",
+			html: "<h1>Title</h1>text<hr>after",
+			want: "Title\n\ntext\n\n---\n\nafter",
+		},
+		{
+			name: "preformatted",
+			html: "<pre>a  b\n  c</pre>",
+			want: "a  b\n  c",
+		},
+		{
+			name: "quote",
+			html: "<p>Said:</p><blockquote><p>one</p><p>two</p></blockquote>",
+			want: "Said:\n\n> one\n>\n> two",
+		},
+		{
+			name: "unordered list",
+			html: "<ul><li>one</li><li>two</li></ul>",
+			want: "- one\n- two",
+		},
+		{
+			name: "ordered list",
+			html: `<ol start="3"><li>three</li><li>four</li></ol>`,
+			want: "3. three\n4. four",
+		},
+		{
+			name: "nested list",
+			html: "<ul><li>one<ul><li>inner</li></ul></li><li>two</li></ul>",
+			want: "- one\n  - inner\n- two",
+		},
+		{
+			name: "table",
+			html: "<table><tr><th>Name</th><th>Qty</th></tr><tr><td>Apple</td><td>2</td></tr></table>",
+			want: "Name | Qty\nApple | 2",
+		},
+		{
+			name: "layout table",
+			html: "<table><tr><td><p>left</p><p>more</p></td><td>right</td></tr></table>",
+			want: "left\n\nmore\nright",
+		},
+		{
+			name: "links",
+			html: `<p>Go <a href="https://example.com/a">here</a> or <a href="https://example.com/b">there</a>, <a href="https://example.com/a">again</a>.</p>`,
+			want: "Go here[1] or there[2], again[1].\n\n[1] https://example.com/a\n[2] https://example.com/b",
+		},
+		{
+			name: "links in tables share footnotes",
+			html: `<table><tr><td><a href="https://example.com/a">a</a></td></tr></table><a href="https://example.com/a">b</a>`,
+			want: "a[1]\nb[1]\n\n[1] https://example.com/a",
+		},
+		{
+			name: "links without footnotes",
+			html: `<a href="https://example.com/">https://example.com/</a> <a href="mailto:a@example.com">a@example.com</a> <a href="#top">top</a> <a href="javascript:void(0)">js</a>`,
+			want: "https://example.com/ a@example.com top js",
+		},
+		{
+			name:   "inline links",
+			html:   `<p>Go <a href="https://example.com/a">here</a>.</p>`,
+			inline: true,
+			want:   "Go here <https://example.com/a>.",
+		},
+		{
+			name: "hidden",
+			html: `<div style="display: none">preheader</div><span hidden>hidden</span><div style="visibility:hidden">invisible</div><div style="mso-hide: all">outlook</div><p>shown</p>`,
+			want: "shown",
+		},
+		{
+			name: "dropped elements",
+			html: `<html><head><title>Title</title><style>p{}</style></head><body><script>alert(1)</script><p>text</p></body></html>`,
+			want: "text",
+		},
+		{
+			name: "zero width padding",
+			html: "<p>Hi\u200b\u200c\u00ad there</p>",
+			want: "Hi there",
+		},
+		{
+			name: "tracking pixels",
+			html: `<p>text<img src="https://t.example.com/p.gif" width="1" height="1" alt="pixel"><img src="x.gif" style="width:0px;height:0px" alt="styled"><img src="logo.png" alt="Logo"></p>`,
+			want: "textLogo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := HTMLToText(tt.html, HTMLTextOptions{InlineLinks: tt.inline})
+			if got != tt.want {
+				t.Errorf("HTMLToText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTMLToTextManyLinks(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&b, `<a href="https://example.com/%d">%d</a> <a href="https://example.com/0">again</a> `, i, i)
+	}
+
+	out := HTMLToText(b.String(), HTMLTextOptions{})
+	if !strings.HasSuffix(out, "[20000] https://example.com/19999") {
+		t.Errorf("last footnote missing: %q", out[max(0, len(out)-100):])
+	}
+	if strings.Count(out, "https://example.com/0\n") != 1 {
+		t.Error("footnote of the repeated link listed twice")
+	}
+}
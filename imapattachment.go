@@ -0,0 +1,209 @@
+package mailreader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// StreamAttachments streams the attachments of the message uid of box to
+// sink, see the StreamAttachments function. The message is not fetched
+// whole: its BODYSTRUCTURE comes first, then the headers of its leaf parts,
+// then the body of each attachment kept, one at a time. Attachments over
+// MaxMessageSize are skipped, ErrMessageTooLarge is then returned with the
+// others.
+func (r *ImapReader) StreamAttachments(box string, uid uint32, filter *AttachmentFilter, sink AttachmentSink) ([]Attachment, error) {
+	if !r.hasRoute() {
+		return nil, ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(box, true); err != nil {
+		return nil, err
+	}
+
+	msg, err := fetchOne(c, uid, []imap.FetchItem{imap.FetchBodyStructure})
+	if err != nil {
+		return nil, err
+	}
+	if msg.BodyStructure == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	limits := r.limits()
+	w := &structureWalker{limits: limits}
+	w.walk(msg.BodyStructure, nil, 0, true)
+	if len(w.leaves) == 0 {
+		return nil, w.truncated
+	}
+
+	items := make([]imap.FetchItem, 0, len(w.leaves))
+	for _, l := range w.leaves {
+		items = append(items, l.header.FetchItem())
+	}
+	headers, err := fetchOne(c, uid, items)
+	if err != nil {
+		return nil, err
+	}
+
+	var atts []Attachment
+	for _, l := range w.leaves {
+		path := partPath(l.path)
+		literal := headers.GetBody(l.header)
+		if literal == nil {
+			return atts, fmt.Errorf("part %v: %w", path, ErrInvalidResponse)
+		}
+		m, err := readMessage(literal, limits.MaxHeaderSize)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			w.truncate(err)
+			continue
+		}
+		if err != nil {
+			return atts, fmt.Errorf("part %v: %w", path, err)
+		}
+
+		p := newMimePart(textproto.MIMEHeader(m.Header), path)
+		if !wantAttachment(p, filter) {
+			continue
+		}
+		if limits.tooLarge(int64(l.size)) {
+			w.truncate(ErrMessageTooLarge)
+			continue
+		}
+
+		section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: l.path}, Peek: true}
+		msg, err := fetchOne(c, uid, []imap.FetchItem{section.FetchItem()})
+		if err != nil {
+			return atts, err
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			return atts, fmt.Errorf("part %v: %w", path, ErrInvalidResponse)
+		}
+
+		a, err := sinkAttachment(p, transferReader(p.Header.Get("Content-Transfer-Encoding"), body), filter, sink)
+		if err != nil {
+			return atts, err
+		}
+		if a != nil {
+			atts = append(atts, *a)
+		}
+	}
+	return atts, w.truncated
+}
+
+// fetchOne fetches items of the message uid.
+func fetchOne(c *client.Client, uid uint32, items []imap.FetchItem) (*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, items, messages); err != nil {
+		return nil, err
+	}
+	msg := <-messages
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	return msg, nil
+}
+
+// imapLeaf is a leaf part of the BODYSTRUCTURE of a message.
+type imapLeaf struct {
+	path []int
+	// header is the section holding the header of the part: its MIME
+	// header, or the header of the message it is the body of.
+	header *imap.BodySectionName
+	// size is the size of the body, transfer encoding included.
+	size uint32
+}
+
+// structureWalker lists the leaves of a BODYSTRUCTURE within the limits,
+// numbering and counting the parts the way mimeWalker does.
+type structureWalker struct {
+	limits Limits
+
+	parts  int
+	leaves []imapLeaf
+	// truncated is the first limit broken
+	truncated error
+}
+
+func (w *structureWalker) truncate(reason error) {
+	if w.truncated == nil {
+		w.truncated = reason
+	}
+}
+
+// tooManyParts reports whether more parts were met than MaxParts allows.
+func (w *structureWalker) tooManyParts() bool {
+	return w.limits.MaxParts > 0 && w.parts > w.limits.MaxParts
+}
+
+// walk lists the leaves of bs found at path base. root is set for the
+// structure of a whole message, top level or attached.
+func (w *structureWalker) walk(bs *imap.BodyStructure, base []int, depth int, root bool) {
+	w.parts++
+	if w.tooManyParts() {
+		w.truncate(ErrTooManyParts)
+		return
+	}
+
+	multipart := strings.EqualFold(bs.MIMEType, "multipart") && len(bs.Parts) > 0
+	message := strings.EqualFold(bs.MIMEType+"/"+bs.MIMESubType, "message/rfc822") && bs.BodyStructure != nil
+	if (multipart || message) && w.limits.MaxDepth > 0 && depth >= w.limits.MaxDepth {
+		// kept as a leaf of raw content
+		w.truncate(ErrTooDeep)
+		multipart, message = false, false
+	}
+
+	switch {
+	case multipart:
+		for i, part := range bs.Parts {
+			w.walk(part, append(base[:len(base):len(base)], i+1), depth+1, false)
+			if w.tooManyParts() {
+				break
+			}
+		}
+		return
+
+	case message:
+		w.walk(bs.BodyStructure, base, depth+1, true)
+		return
+	}
+
+	l := imapLeaf{
+		path: base,
+		header: &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Specifier: imap.MIMESpecifier, Path: base},
+			Peek:         true,
+		},
+		size: bs.Size,
+	}
+	if root {
+		// the body of a single part message
+		l.path = append(base[:len(base):len(base)], 1)
+		l.header.Specifier = imap.HeaderSpecifier
+	}
+	w.leaves = append(w.leaves, l)
+}
+
+// partPath formats path the way MimePart.Path is.
+func partPath(path []int) string {
+	s := make([]string, len(path))
+	for i, n := range path {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ".")
+}
@@ -0,0 +1,86 @@
+package mailreader
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestStructureWalker(t *testing.T) {
+	leaf := func(t, sub string) *imap.BodyStructure {
+		return &imap.BodyStructure{MIMEType: t, MIMESubType: sub, Size: 10}
+	}
+	multipart := func(parts ...*imap.BodyStructure) *imap.BodyStructure {
+		return &imap.BodyStructure{MIMEType: "multipart", MIMESubType: "mixed", Parts: parts}
+	}
+	message := func(inner *imap.BodyStructure) *imap.BodyStructure {
+		return &imap.BodyStructure{MIMEType: "message", MIMESubType: "rfc822", BodyStructure: inner}
+	}
+
+	tests := []struct {
+		name      string
+		bs        *imap.BodyStructure
+		limits    Limits
+		want      []string
+		truncated error
+	}{
+		{
+			name: "single part",
+			bs:   leaf("application", "pdf"),
+			want: []string{"1 BODY.PEEK[HEADER]"},
+		},
+		{
+			name: "multipart",
+			bs:   multipart(leaf("text", "plain"), leaf("application", "pdf")),
+			want: []string{"1 BODY.PEEK[1.MIME]", "2 BODY.PEEK[2.MIME]"},
+		},
+		{
+			name: "nested multipart",
+			bs:   multipart(multipart(leaf("text", "plain"), leaf("text", "html")), leaf("image", "png")),
+			want: []string{"1.1 BODY.PEEK[1.1.MIME]", "1.2 BODY.PEEK[1.2.MIME]", "2 BODY.PEEK[2.MIME]"},
+		},
+		{
+			name: "attached single part message",
+			bs:   multipart(leaf("text", "plain"), message(leaf("application", "pdf"))),
+			want: []string{"1 BODY.PEEK[1.MIME]", "2.1 BODY.PEEK[2.HEADER]"},
+		},
+		{
+			name: "attached multipart message",
+			bs:   multipart(leaf("text", "plain"), message(multipart(leaf("text", "plain"), leaf("image", "png")))),
+			want: []string{"1 BODY.PEEK[1.MIME]", "2.1 BODY.PEEK[2.1.MIME]", "2.2 BODY.PEEK[2.2.MIME]"},
+		},
+		{
+			name:      "too many parts",
+			bs:        multipart(leaf("text", "plain"), leaf("image", "png"), leaf("image", "gif")),
+			limits:    Limits{MaxParts: 3},
+			want:      []string{"1 BODY.PEEK[1.MIME]", "2 BODY.PEEK[2.MIME]"},
+			truncated: ErrTooManyParts,
+		},
+		{
+			name:      "too deep",
+			bs:        multipart(leaf("text", "plain"), message(multipart(leaf("image", "png")))),
+			limits:    Limits{MaxDepth: 2},
+			want:      []string{"1 BODY.PEEK[1.MIME]", "2.1 BODY.PEEK[2.HEADER]"},
+			truncated: ErrTooDeep,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &structureWalker{limits: tt.limits.withDefaults()}
+			w.walk(tt.bs, nil, 0, true)
+
+			var got []string
+			for _, l := range w.leaves {
+				got = append(got, partPath(l.path)+" "+string(l.header.FetchItem()))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("leaves = %q, want %q", got, tt.want)
+			}
+			if w.truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", w.truncated, tt.truncated)
+			}
+		})
+	}
+}
@@ -4,17 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime"
-	"mime/multipart"
-	"net/mail"
 	"strings"
 	"time"
 
-	"github.com/New-Moon-Team/gomailreader/proxy"
-
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 )
@@ -55,26 +51,12 @@ func (r *ImapReader) BoxGetAll(mailbox MailBox, res *[]byte) error {
 }
 func (r *ImapReader) GetAllBoxes() error {
 	//TODO: implement further on demand
-	d, err := proxy.NewHTTPDialer(r.Proxy)
-	if err != nil {
-		return err
-	}
-
-	addr := fmt.Sprintf("%v:%s", r.Server, "993")
-
-	r.log(fmt.Sprintf("Dialing address %v", addr))
-	c, err := client.DialWithDialerTLS(d, addr, &tls.Config{InsecureSkipVerify: true})
-	//c, err := client.DialWithDialerTLS(d, "imap-mail.outlook.com:993", &tls.Config{InsecureSkipVerify: true})
+	c, err := r.connect(context.Background())
 	if err != nil {
 		return err
 	}
 	defer c.Logout()
 
-	err = c.Login(r.User, r.Password)
-	if err != nil {
-		return err
-	}
-
 	// List mailboxes
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
@@ -90,121 +72,100 @@ func (r *ImapReader) GetAllBoxes() error {
 	return nil
 }
 func (r *ImapReader) GetLatestMsgOf(ctx context.Context, res *[]byte, box, receiver string) error {
-	d, err := proxy.NewHTTPDialer(r.Proxy)
+	pred := MessagePredicate{
+		Receiver: receiver,
+		After:    time.Now().Add(-5 * time.Minute),
+		Unseen:   true,
+	}
+
+	err := r.WaitForMessage(ctx, res, box, pred, WaitOptions{MarkSeen: true})
+	if errors.Is(err, ErrWaitTimeout) || errors.Is(err, context.Canceled) {
+		// kept for callers relying on the historical behaviour: an empty
+		// result and no error once the context is done
+		return nil
+	}
+
+	return err
+}
+
+// connect dials the configured server through the proxy and logs in.
+func (r *ImapReader) connect(ctx context.Context) (*client.Client, error) {
+	tlsConfig, err := r.tlsConfig()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		r.warn("Warn: TLS certificate verification is disabled")
 	}
 
-	addr := fmt.Sprintf("%v:%s", r.Server, "993")
+	addr := r.addr(993, 143)
 
 	r.log(fmt.Sprintf("Dialing address %v", addr))
-	c, err := client.DialWithDialerTLS(d, addr, &tls.Config{InsecureSkipVerify: true})
-	//c, err := client.DialWithDialerTLS(d, "imap-mail.outlook.com:993", &tls.Config{InsecureSkipVerify: true})
+	conn, err := r.dial(ctx, addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if r.implicitTLS() {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
 	}
-	defer c.Logout()
 
-	err = c.Login(r.User, r.Password)
+	c, err := client.New(conn)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			_, err = c.Select(box, false)
-			if err != nil {
-				return err
-			}
-
-			cr := imap.NewSearchCriteria()
-			//since last 5 minutes
-			cr.Since = time.Now().Add(-5 * time.Minute)
-			cr.WithoutFlags = []string{imap.SeenFlag}
-			ids, err := c.Search(cr)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("Search result: %v\n", ids)
-
-			if len(ids) == 0 {
-				time.Sleep(time.Second * 5)
-				continue
-			}
-
-			seqset := new(imap.SeqSet)
-			seqset.AddNum(ids...)
-
-			messages := make(chan *imap.Message, 10)
-			done := make(chan error, 1)
-			go func() {
-				done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope}, messages)
-			}()
-
-			var (
-				seqn  uint32
-				mtime time.Time
-			)
-			for msg := range messages {
-				for _, t := range msg.Envelope.To {
-					// fmt.Printf("to: %s\n", t.Address())
-					if t.Address() == receiver {
-						if seqn == 0 || mtime.Before(msg.Envelope.Date) {
-							seqn = msg.SeqNum
-							mtime = msg.Envelope.Date
-							fmt.Printf("mid: %d\n", seqn)
-						}
-					}
-				}
-			}
-			if err := <-done; err != nil {
-				return err
-			}
-
-			if seqn == 0 {
-				time.Sleep(time.Second * 5)
-				continue
-			}
+	if r.Security == SecurityStartTLS {
+		if ok, _ := c.SupportStartTLS(); !ok {
+			c.Logout()
+			return nil, ErrStartTLSNotSupported
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, err
+		}
+	}
 
-			seqset = new(imap.SeqSet)
-			seqset.AddNum(seqn)
+	if r.TokenSource != nil {
+		err = r.authenticate(ctx, c)
+	} else {
+		var password string
+		if password, err = r.password(ctx); err == nil {
+			err = c.Login(r.User, password)
+		}
+	}
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
+	r.log(fmt.Sprintf("Logged in as %v", r.User))
 
-			messages = make(chan *imap.Message, 1)
-			done = make(chan error, 1)
-			go func() {
-				done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822}, messages)
-			}()
+	return c, nil
+}
 
-			msg := <-messages
-			m, err := r.parseMsg(msg)
-			if err != nil {
-				log.Printf("parse msg error: %v\n", err)
-				time.Sleep(time.Second * 5)
-				continue
-			}
+// authenticate logs in with an OAuth2 access token.
+func (r *ImapReader) authenticate(ctx context.Context, c *client.Client) error {
+	t, err := r.TokenSource.Token(ctx)
+	if err != nil {
+		return err
+	}
 
-			b, err := json.Marshal(m)
-			if err != nil {
-				return err
+	mech := r.Auth
+	if mech == "" {
+		mech = AuthXOAuth2
+		if ok, _ := c.SupportAuth(string(AuthXOAuth2)); !ok {
+			if ok, _ := c.SupportAuth(string(AuthOAuthBearer)); ok {
+				mech = AuthOAuthBearer
 			}
-			*res = b
-
-			defer func() {
-				item := imap.FormatFlagsOp(imap.AddFlags, true)
-				flags := []interface{}{imap.SeenFlag}
-				err = c.Store(seqset, item, flags, nil)
-				if err != nil {
-					log.Printf("err mark mail seen: %v\n", err)
-				}
-			}()
-
-			return nil
 		}
 	}
-	return nil
+
+	return c.Authenticate(oauthClient(mech, r.User, t.AccessToken, string(r.Server), r.port(993, 143)))
 }
 
 func (r *ImapReader) parseMsg(msg *imap.Message) (*ImapMail, error) {
@@ -212,72 +173,156 @@ func (r *ImapReader) parseMsg(msg *imap.Message) (*ImapMail, error) {
 
 	ml.Uid = msg.Uid
 
+	charset := r.parseBody(&ml, msg)
+
+	ml.Date = msg.Envelope.Date.Local()
+	ml.Subject = decodeHeader(msg.Envelope.Subject, charset)
+	ml.From = ml.addresses(msg.Envelope.From, charset)
+	ml.Sender = ml.addresses(msg.Envelope.Sender, charset)
+	ml.ReplyTo = ml.addresses(msg.Envelope.ReplyTo, charset)
+	ml.To = ml.addresses(msg.Envelope.To, charset)
+	ml.Cc = ml.addresses(msg.Envelope.Cc, charset)
+	ml.Bcc = ml.addresses(msg.Envelope.Bcc, charset)
+	ml.InReplyTo = msg.Envelope.InReplyTo
+	ml.MessageId = msg.Envelope.MessageId
+
+	return &ml, nil
+}
+
+// parseBody sets the parts and the attachments of ml from the body of msg,
+// marking ml truncated when a limit cut it short. It returns the charset of
+// the first text part, see MimePart.textCharset.
+func (r *ImapReader) parseBody(ml *ImapMail, msg *imap.Message) string {
+	var charset string
+	limits := r.limits()
+	if limits.tooLarge(int64(msg.Size)) {
+		// only the header was fetched
+		ml.truncate(ErrMessageTooLarge.Error())
+	}
+
 	for _, value := range msg.Body {
-		m, err := mail.ReadMessage(value)
-		if err != nil {
+		m, err := readMessage(value, limits.MaxHeaderSize)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			ml.truncate(err.Error())
+		} else if err != nil {
 			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
 			continue
 		}
 
-		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		tree, err := ParseMimeTreeLimits(m, limits)
 		if err != nil {
-			r.warn(fmt.Sprintf("Warn: parsing media type error %v", err))
-			continue
+			r.warn(fmt.Sprintf("Warn: parsing parts error %v", err))
 		}
+		ml.truncate(tree.TruncatedReason)
 
-		if strings.HasPrefix(mediaType, "multipart/") {
-			mr := multipart.NewReader(m.Body, params["boundary"])
-
-			for {
-				p, err := mr.NextPart()
-				if err == io.EOF {
-					break
-				}
-
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: getting part error %v", err))
-					continue
-				}
-
-				slurp, err := io.ReadAll(p)
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: reading part error %v", err))
-					continue
-				}
-
-				var mp ImapMailPart
-				mp.ContentType = p.Header.Get("Content-Type")
-				mp.Content = string(slurp)
-
-				ml.Parts = append(ml.Parts, mp)
+		for _, p := range tree.Leaves() {
+			if p.IsAttachment() {
+				continue
 			}
+			ml.Parts = append(ml.Parts, ImapMailPart{
+				Path:        p.Path,
+				ContentType: partContentType(p),
+				Charset:     p.Charset,
+				Content:     p.Content,
+			})
+		}
+		ml.Attachments = append(ml.Attachments, tree.Attachments()...)
+		if charset == "" {
+			charset = tree.textCharset()
 		}
 	}
+	return charset
+}
 
-	ml.Date = msg.Envelope.Date.Local()
-	ml.Subject = msg.Envelope.Subject
-	for _, a := range msg.Envelope.From {
-		ml.From = append(ml.From, a.Address())
+// headerSection fetches the header of the messages over MaxMessageSize.
+var headerSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+// fetchLimited fetches items of the messages of seqset to ch like Fetch,
+// or UidFetch when uid is set, the body of the messages over MaxMessageSize
+// replaced by their header. RFC822.SIZE is always fetched.
+func (r *ImapReader) fetchLimited(c *client.Client, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	fetch := c.Fetch
+	if uid {
+		fetch = c.UidFetch
+	}
+	items = append(items[:len(items):len(items)], imap.FetchRFC822Size)
+
+	limits := r.limits()
+	if limits.MaxMessageSize <= 0 {
+		return fetch(seqset, items, ch)
 	}
-	for _, a := range msg.Envelope.Sender {
-		ml.Sender = append(ml.Sender, a.Address())
+	defer close(ch)
+
+	// the sizes first, to know what can be fetched whole
+	small, large := new(imap.SeqSet), new(imap.SeqSet)
+	sizes := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, sizes)
+	}()
+	for msg := range sizes {
+		id := msg.SeqNum
+		if uid {
+			id = msg.Uid
+		}
+		if limits.tooLarge(int64(msg.Size)) {
+			large.AddNum(id)
+		} else {
+			small.AddNum(id)
+		}
 	}
-	for _, a := range msg.Envelope.ReplyTo {
-		ml.ReplyTo = append(ml.ReplyTo, a.Address())
+	if err := <-done; err != nil {
+		return err
 	}
-	for _, a := range msg.Envelope.To {
-		ml.To = append(ml.To, a.Address())
+
+	headerItems := []imap.FetchItem{headerSection.FetchItem()}
+	for _, item := range items {
+		if item != imap.FetchRFC822 && !strings.HasPrefix(string(item), "BODY[") && !strings.HasPrefix(string(item), "BODY.PEEK[") {
+			headerItems = append(headerItems, item)
+		}
 	}
-	for _, a := range msg.Envelope.Cc {
-		ml.Cc = append(ml.Cc, a.Address())
+
+	forward := func(set *imap.SeqSet, items []imap.FetchItem) error {
+		if set.Empty() {
+			return nil
+		}
+
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- fetch(set, items, messages)
+		}()
+		for msg := range messages {
+			ch <- msg
+		}
+		return <-done
 	}
-	for _, a := range msg.Envelope.Bcc {
-		ml.Bcc = append(ml.Bcc, a.Address())
+
+	if err := forward(small, items); err != nil {
+		return err
 	}
-	ml.InReplyTo = msg.Envelope.InReplyTo
-	ml.MessageId = msg.Envelope.MessageId
+	return forward(large, headerItems)
+}
 
-	return &ml, nil
+// addresses returns the bare addresses of list, keeping their decoded
+// display names in m.Names.
+func (m *ImapMail) addresses(list []*imap.Address, charset string) []string {
+	var addrs []string
+	for _, a := range list {
+		addr := a.Address()
+		addrs = append(addrs, addr)
+
+		if name := decodeHeader(a.PersonalName, charset); name != "" {
+			if m.Names == nil {
+				m.Names = make(map[string]string)
+			}
+			m.Names[addr] = name
+		}
+	}
+	return addrs
 }
 
 func (r *ImapReader) gmailBoxGetAll(box string) ([]ImapMail, error) {
@@ -285,31 +330,16 @@ func (r *ImapReader) gmailBoxGetAll(box string) ([]ImapMail, error) {
 
 	var mails []ImapMail
 
-	if r.Proxy == nil {
+	if !r.hasRoute() {
 		return mails, ErrNoProxy
 	}
 
-	d, err := proxy.NewHTTPDialer(r.Proxy)
-	if err != nil {
-		return mails, err
-	}
-
-	addr := fmt.Sprintf("%v:%s", r.Server, "993")
-
-	r.log(fmt.Sprintf("Dialing address %v", addr))
-	c, err := client.DialWithDialerTLS(d, addr, &tls.Config{InsecureSkipVerify: true})
-	//c, err := client.DialWithDialerTLS(d, "imap-mail.outlook.com:993", &tls.Config{InsecureSkipVerify: true})
+	c, err := r.connect(context.Background())
 	if err != nil {
 		return mails, err
 	}
 	defer c.Logout()
 
-	err = c.Login(r.User, r.Password)
-	if err != nil {
-		return mails, err
-	}
-	r.log(fmt.Sprintf("Logged in as %v", r.User))
-
 	r.log(fmt.Sprintf("Selecting box: %v", box))
 	mbox, err := c.Select(box, false)
 	if err != nil {
@@ -328,7 +358,7 @@ func (r *ImapReader) gmailBoxGetAll(box string) ([]ImapMail, error) {
 	done := make(chan error, 1)
 
 	go func() {
-		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822}, messages)
+		done <- r.fetchLimited(c, false, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822}, messages)
 	}()
 
 	r.log("Converting messages")
@@ -337,68 +367,16 @@ func (r *ImapReader) gmailBoxGetAll(box string) ([]ImapMail, error) {
 
 		ml.Uid = msg.Uid
 
-		for _, value := range msg.Body {
-			m, err := mail.ReadMessage(value)
-			if err != nil {
-				r.warn(fmt.Sprintf("Warn: reading message error %v", err))
-				continue
-			}
-
-			mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
-			if err != nil {
-				r.warn(fmt.Sprintf("Warn: parsing media type error %v", err))
-				continue
-			}
-
-			if strings.HasPrefix(mediaType, "multipart/") {
-				mr := multipart.NewReader(m.Body, params["boundary"])
-
-				for {
-					p, err := mr.NextPart()
-					if err == io.EOF {
-						break
-					}
-
-					if err != nil {
-						r.warn(fmt.Sprintf("Warn: getting part error %v", err))
-						continue
-					}
-
-					slurp, err := io.ReadAll(p)
-					if err != nil {
-						r.warn(fmt.Sprintf("Warn: reading part error %v", err))
-						continue
-					}
-
-					var mp ImapMailPart
-					mp.ContentType = p.Header.Get("Content-Type")
-					mp.Content = string(slurp)
-
-					ml.Parts = append(ml.Parts, mp)
-				}
-			}
-		}
+		charset := r.parseBody(&ml, msg)
 
 		ml.Date = msg.Envelope.Date
-		ml.Subject = msg.Envelope.Subject
-		for _, a := range msg.Envelope.From {
-			ml.From = append(ml.From, a.Address())
-		}
-		for _, a := range msg.Envelope.Sender {
-			ml.Sender = append(ml.Sender, a.Address())
-		}
-		for _, a := range msg.Envelope.ReplyTo {
-			ml.ReplyTo = append(ml.ReplyTo, a.Address())
-		}
-		for _, a := range msg.Envelope.To {
-			ml.To = append(ml.To, a.Address())
-		}
-		for _, a := range msg.Envelope.Cc {
-			ml.Cc = append(ml.Cc, a.Address())
-		}
-		for _, a := range msg.Envelope.Bcc {
-			ml.Bcc = append(ml.Bcc, a.Address())
-		}
+		ml.Subject = decodeHeader(msg.Envelope.Subject, charset)
+		ml.From = ml.addresses(msg.Envelope.From, charset)
+		ml.Sender = ml.addresses(msg.Envelope.Sender, charset)
+		ml.ReplyTo = ml.addresses(msg.Envelope.ReplyTo, charset)
+		ml.To = ml.addresses(msg.Envelope.To, charset)
+		ml.Cc = ml.addresses(msg.Envelope.Cc, charset)
+		ml.Bcc = ml.addresses(msg.Envelope.Bcc, charset)
 		ml.InReplyTo = msg.Envelope.InReplyTo
 		ml.MessageId = msg.Envelope.MessageId
 		ml.Box = box
@@ -423,31 +401,16 @@ func (r *ImapReader) hotmailBoxGetAll(box string) ([]ImapMail, error) {
 
 	var mails []ImapMail
 
-	if r.Proxy == nil {
+	if !r.hasRoute() {
 		return mails, ErrNoProxy
 	}
 
-	d, err := proxy.NewHTTPDialer(r.Proxy)
-	if err != nil {
-		return mails, err
-	}
-
-	addr := fmt.Sprintf("%v:%s", r.Server, "993")
-
-	r.log(fmt.Sprintf("Dialing address %v", addr))
-	c, err := client.DialWithDialerTLS(d, addr, &tls.Config{InsecureSkipVerify: true})
-	//c, err := client.DialWithDialerTLS(d, "imap-mail.outlook.com:993", &tls.Config{InsecureSkipVerify: true})
+	c, err := r.connect(context.Background())
 	if err != nil {
 		return mails, err
 	}
 	defer c.Logout()
 
-	err = c.Login(r.User, r.Password)
-	if err != nil {
-		return mails, err
-	}
-	r.log(fmt.Sprintf("Logged in as %v", r.User))
-
 	r.log(fmt.Sprintf("Selecting box: %v", box))
 	mbox, err := c.Select(box, false)
 	if err != nil {
@@ -466,7 +429,7 @@ func (r *ImapReader) hotmailBoxGetAll(box string) ([]ImapMail, error) {
 	done := make(chan error, 1)
 
 	go func() {
-		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822}, messages)
+		done <- r.fetchLimited(c, false, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822}, messages)
 	}()
 
 	r.log("Converting messages")
@@ -475,68 +438,16 @@ func (r *ImapReader) hotmailBoxGetAll(box string) ([]ImapMail, error) {
 
 		ml.Uid = msg.Uid
 
-		for _, value := range msg.Body {
-			m, err := mail.ReadMessage(value)
-			if err != nil {
-				r.warn(fmt.Sprintf("Warn: reading message error %v", err))
-				continue
-			}
-
-			mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
-			if err != nil {
-				r.warn(fmt.Sprintf("Warn: parsing media type error %v", err))
-				continue
-			}
-
-			if strings.HasPrefix(mediaType, "multipart/") {
-				mr := multipart.NewReader(m.Body, params["boundary"])
-
-				for {
-					p, err := mr.NextPart()
-					if err == io.EOF {
-						break
-					}
-
-					if err != nil {
-						r.warn(fmt.Sprintf("Warn: getting part error %v", err))
-						continue
-					}
-
-					slurp, err := io.ReadAll(p)
-					if err != nil {
-						r.warn(fmt.Sprintf("Warn: reading part error %v", err))
-						continue
-					}
-
-					var mp ImapMailPart
-					mp.ContentType = p.Header.Get("Content-Type")
-					mp.Content = string(slurp)
-
-					ml.Parts = append(ml.Parts, mp)
-				}
-			}
-		}
+		charset := r.parseBody(&ml, msg)
 
 		ml.Date = msg.Envelope.Date
-		ml.Subject = msg.Envelope.Subject
-		for _, a := range msg.Envelope.From {
-			ml.From = append(ml.From, a.Address())
-		}
-		for _, a := range msg.Envelope.Sender {
-			ml.Sender = append(ml.Sender, a.Address())
-		}
-		for _, a := range msg.Envelope.ReplyTo {
-			ml.ReplyTo = append(ml.ReplyTo, a.Address())
-		}
-		for _, a := range msg.Envelope.To {
-			ml.To = append(ml.To, a.Address())
-		}
-		for _, a := range msg.Envelope.Cc {
-			ml.Cc = append(ml.Cc, a.Address())
-		}
-		for _, a := range msg.Envelope.Bcc {
-			ml.Bcc = append(ml.Bcc, a.Address())
-		}
+		ml.Subject = decodeHeader(msg.Envelope.Subject, charset)
+		ml.From = ml.addresses(msg.Envelope.From, charset)
+		ml.Sender = ml.addresses(msg.Envelope.Sender, charset)
+		ml.ReplyTo = ml.addresses(msg.Envelope.ReplyTo, charset)
+		ml.To = ml.addresses(msg.Envelope.To, charset)
+		ml.Cc = ml.addresses(msg.Envelope.Cc, charset)
+		ml.Bcc = ml.addresses(msg.Envelope.Bcc, charset)
 		ml.InReplyTo = msg.Envelope.InReplyTo
 		ml.MessageId = msg.Envelope.MessageId
 		ml.Box = box
@@ -554,6 +465,59 @@ func (r *ImapReader) hotmailBoxGetAll(box string) ([]ImapMail, error) {
 	return mails, nil
 }
 
+// RenderHTML renders the message uid of box as a self-contained HTML
+// document, see MimePart.RenderHTML. A message over MaxMessageSize is not
+// fetched, ErrMessageTooLarge is returned.
+func (r *ImapReader) RenderHTML(box string, uid uint32, opts RenderOptions) (string, error) {
+	var doc string
+	err := r.fetchRaw(box, uid, func(msg io.Reader) error {
+		var err error
+		doc, err = renderMessage(msg, opts, r.limits())
+		return err
+	})
+	return doc, err
+}
+
+// fetchRaw hands the raw message uid of box to read, without marking it
+// seen. A message over MaxMessageSize is not fetched.
+func (r *ImapReader) fetchRaw(box string, uid uint32, read func(msg io.Reader) error) error {
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(box, true); err != nil {
+		return err
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	if limits := r.limits(); limits.MaxMessageSize > 0 {
+		msg, err := fetchOne(c, uid, []imap.FetchItem{imap.FetchRFC822Size})
+		if err != nil {
+			return err
+		}
+		if limits.tooLarge(int64(msg.Size)) {
+			return ErrMessageTooLarge
+		}
+	}
+
+	msg, err := fetchOne(c, uid, []imap.FetchItem{section.FetchItem()})
+	if err != nil {
+		return err
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return ErrMessageNotFound
+	}
+
+	return read(literal)
+}
+
 func (r *ImapReader) log(l string) {
 }
 func (r *ImapReader) warn(w string) {
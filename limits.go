@@ -0,0 +1,145 @@
+package mailreader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"net/textproto"
+)
+
+// Limits bounds what is read of a message, against huge or malicious ones.
+// A message breaking a limit is kept, marked truncated with the reason,
+// holding what was read within the limits.
+//
+// A zero field takes its value from DefaultLimits, a negative one lifts
+// the limit. No field of DefaultLimits is zero.
+type Limits struct {
+	// MaxMessageSize is the size in octets above which only the header of
+	// a message is fetched. It is checked against RFC822.SIZE for IMAP and
+	// LIST for POP3, before fetching.
+	MaxMessageSize int64
+	// MaxParts bounds the number of MIME parts walked.
+	MaxParts int
+	// MaxDepth bounds the nesting of multipart parts and attached messages.
+	MaxDepth int
+	// MaxDecodedSize bounds the decoded content kept in memory for the
+	// whole message. Streamed attachments do not count.
+	MaxDecodedSize int64
+	// MaxHeaderSize bounds the size in octets of the header of the message
+	// and of each of its parts.
+	MaxHeaderSize int
+}
+
+// DefaultLimits are used when ReaderConfig.Limits is nil, and for the
+// fields left to zero. MaxMessageSize is above what the large providers
+// accept by default once attachments are base64 encoded, 25 MB of Gmail
+// attachments making a message of about 34 MB, and the decoded content of
+// such a message fits MaxDecodedSize.
+var DefaultLimits = Limits{
+	MaxMessageSize: 64 << 20,
+	MaxParts:       1000,
+	MaxDepth:       100,
+	MaxDecodedSize: 50 << 20,
+	MaxHeaderSize:  1 << 20,
+}
+
+// withDefaults fills the zero fields of l from DefaultLimits.
+func (l Limits) withDefaults() Limits {
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = DefaultLimits.MaxMessageSize
+	}
+	if l.MaxParts == 0 {
+		l.MaxParts = DefaultLimits.MaxParts
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = DefaultLimits.MaxDepth
+	}
+	if l.MaxDecodedSize == 0 {
+		l.MaxDecodedSize = DefaultLimits.MaxDecodedSize
+	}
+	if l.MaxHeaderSize == 0 {
+		l.MaxHeaderSize = DefaultLimits.MaxHeaderSize
+	}
+	return l
+}
+
+// tooLarge reports whether a message of size octets is over the limit.
+func (l Limits) tooLarge(size int64) bool {
+	return l.MaxMessageSize > 0 && size > l.MaxMessageSize
+}
+
+// limits returns the limits of the account, defaults applied.
+func (c *ReaderConfig) limits() Limits {
+	if c.Limits == nil {
+		return DefaultLimits.withDefaults()
+	}
+	return c.Limits.withDefaults()
+}
+
+// readMessage reads a message like mail.ReadMessage, but for a header over
+// max octets when max is positive: the header is then cut after its last
+// full line, the body is left out and ErrHeaderTooLarge is returned with
+// the message.
+func readMessage(r io.Reader, max int) (*mail.Message, error) {
+	if max <= 0 {
+		return mail.ReadMessage(r)
+	}
+
+	br := bufio.NewReader(r)
+	var head []byte
+	start := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		head = append(head, chunk...)
+
+		if len(head) > max {
+			cut := bytes.LastIndexByte(head[:max], '\n') + 1
+			m, err := mail.ReadMessage(bytes.NewReader(append(head[:cut:cut], "\r\n"...)))
+			if err != nil {
+				return nil, err
+			}
+			return m, ErrHeaderTooLarge
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			// a line longer than the buffer
+			continue
+		case err != nil && err != io.EOF:
+			return nil, err
+		}
+
+		line := head[start:]
+		start = len(head)
+		if err == io.EOF || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// the header is complete, parse it again with the body
+			return mail.ReadMessage(io.MultiReader(bytes.NewReader(head), br))
+		}
+	}
+}
+
+// headerSize returns about the size h had on the wire.
+func headerSize(h textproto.MIMEHeader) int {
+	size := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// truncate marks m cut short by a limit, the first reason given is kept.
+func (m *ImapMail) truncate(reason string) {
+	if !m.Truncated && reason != "" {
+		m.Truncated, m.TruncatedReason = true, reason
+	}
+}
+
+// truncate marks m cut short by a limit, the first reason given is kept.
+func (m *Pop3Mail) truncate(reason string) {
+	if !m.Truncated && reason != "" {
+		m.Truncated, m.TruncatedReason = true, reason
+	}
+}
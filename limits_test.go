@@ -0,0 +1,319 @@
+package mailreader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimitsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Limits
+		want Limits
+	}{
+		{"zero", Limits{}, DefaultLimits},
+		{
+			name: "set",
+			in:   Limits{MaxMessageSize: 1, MaxParts: 2, MaxDepth: 3, MaxDecodedSize: 4, MaxHeaderSize: 5},
+			want: Limits{MaxMessageSize: 1, MaxParts: 2, MaxDepth: 3, MaxDecodedSize: 4, MaxHeaderSize: 5},
+		},
+		{
+			name: "lifted",
+			in:   Limits{MaxMessageSize: -1, MaxDecodedSize: -1},
+			want: Limits{MaxMessageSize: -1, MaxParts: 1000, MaxDepth: 100, MaxDecodedSize: -1, MaxHeaderSize: 1 << 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.in.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if (Limits{MaxMessageSize: -1}).tooLarge(1 << 40) {
+		t.Error("a lifted MaxMessageSize is enforced")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	long := "X-Long: " + strings.Repeat("a", 8000) + "\r\n"
+
+	tests := []struct {
+		name    string
+		msg     string
+		max     int
+		subject string
+		body    string
+		err     error
+	}{
+		{
+			name:    "within",
+			msg:     "Subject: hi\r\nTo: a@example.com\r\n\r\nbody",
+			max:     100,
+			subject: "hi",
+			body:    "body",
+		},
+		{
+			name:    "unlimited",
+			msg:     "Subject: hi\r\n" + long + "\r\nbody",
+			subject: "hi",
+			body:    "body",
+		},
+		{
+			name:    "line over the buffer",
+			msg:     "Subject: hi\r\n" + long + "\r\nbody",
+			max:     10000,
+			subject: "hi",
+			body:    "body",
+		},
+		{
+			name:    "cut after the last full line",
+			msg:     "Subject: hi\r\n" + long + "\r\nbody",
+			max:     100,
+			subject: "hi",
+			err:     ErrHeaderTooLarge,
+		},
+		{
+			name:    "header only",
+			msg:     "Subject: hi\r\n",
+			max:     100,
+			subject: "hi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readMessage(strings.NewReader(tt.msg), tt.max)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("readMessage() error = %v, want %v", err, tt.err)
+			}
+			if got := m.Header.Get("Subject"); got != tt.subject {
+				t.Errorf("Subject = %q, want %q", got, tt.subject)
+			}
+			if m.Header.Get("X-Long") != "" && tt.err != nil {
+				t.Error("the cut line is kept")
+			}
+			body, err := io.ReadAll(m.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+// nestedMessage returns a message of depth multipart levels.
+func nestedMessage(depth int) string {
+	body := "Content-Type: text/plain\r\n\r\ndeepest\r\n"
+	for i := depth; i > 0; i-- {
+		b := fmt.Sprintf("b%d", i)
+		body = fmt.Sprintf("Content-Type: multipart/mixed; boundary=%v\r\n\r\n--%v\r\n%v--%v--\r\n", b, b, body, b)
+	}
+	return "Subject: nested\r\n" + body
+}
+
+// multipartMessage returns a message of the given parts.
+func multipartMessage(parts ...string) string {
+	var b strings.Builder
+	b.WriteString("Subject: parts\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n")
+	for _, p := range parts {
+		b.WriteString("--b\r\n" + p + "\r\n")
+	}
+	b.WriteString("--b--\r\n")
+	return b.String()
+}
+
+func TestParseMimeTreeLimits(t *testing.T) {
+	text := "Content-Type: text/plain\r\n\r\nhello"
+	encoded := "Content-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n" + strings.Repeat("QUFB", 100)
+
+	tests := []struct {
+		name   string
+		msg    string
+		limits Limits
+		leaves int
+		reason error
+	}{
+		{
+			name:   "within",
+			msg:    multipartMessage(text, text),
+			leaves: 2,
+		},
+		{
+			name:   "too many parts",
+			msg:    multipartMessage(text, text, text, text),
+			limits: Limits{MaxParts: 3},
+			leaves: 2,
+			reason: ErrTooManyParts,
+		},
+		{
+			name:   "bomb",
+			msg:    multipartMessage(strings.Split(strings.Repeat(text+"|", 2000), "|")[:2000]...),
+			leaves: 999,
+			reason: ErrTooManyParts,
+		},
+		{
+			name:   "deep",
+			msg:    nestedMessage(200),
+			leaves: 1,
+			reason: ErrTooDeep,
+		},
+		{
+			name:   "depth lifted",
+			msg:    nestedMessage(200),
+			limits: Limits{MaxDepth: -1},
+			leaves: 1,
+		},
+		{
+			name:   "decoded too large",
+			msg:    multipartMessage(encoded, encoded),
+			limits: Limits{MaxDecodedSize: 400},
+			leaves: 2,
+			reason: ErrDecodedTooLarge,
+		},
+		{
+			name:   "part header too large",
+			msg:    multipartMessage(text, "X-Long: "+strings.Repeat("a", 200)+"\r\n"+text),
+			limits: Limits{MaxHeaderSize: 100},
+			leaves: 1,
+			reason: ErrHeaderTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readMessage(strings.NewReader(tt.msg), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := ParseMimeTreeLimits(m, tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(tree.Leaves()); got != tt.leaves {
+				t.Errorf("%d leaves, want %d", got, tt.leaves)
+			}
+			if tt.reason == nil {
+				if tree.Truncated {
+					t.Errorf("truncated: %v", tree.TruncatedReason)
+				}
+				return
+			}
+			if !tree.Truncated || tree.TruncatedReason != tt.reason.Error() {
+				t.Errorf("Truncated = %v, %q, want %q", tree.Truncated, tree.TruncatedReason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDecodedSizeCut(t *testing.T) {
+	encoded := "Content-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n" + strings.Repeat("QUFB", 100)
+	m, err := readMessage(strings.NewReader(multipartMessage(encoded, encoded)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := ParseMimeTreeLimits(m, Limits{MaxDecodedSize: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, l := range tree.Leaves() {
+		total += len(l.Content)
+	}
+	if total != 400 {
+		t.Errorf("%d octets decoded, want 400", total)
+	}
+}
+
+func TestWalkStopsAtMaxParts(t *testing.T) {
+	// the first part breaks MaxDepth, the limit recorded, before the parts
+	// run out
+	parts := []string{strings.TrimPrefix(nestedMessage(3), "Subject: nested\r\n")}
+	for i := 0; i < 20; i++ {
+		parts = append(parts, "Content-Type: text/plain\r\n\r\nhello")
+	}
+	m, err := readMessage(strings.NewReader(multipartMessage(parts...)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &mimeWalker{limits: Limits{MaxDepth: 2, MaxParts: 5}.withDefaults()}
+	tree, err := w.parse(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.parts != 6 {
+		t.Errorf("%d parts walked, want 6", w.parts)
+	}
+	if tree.TruncatedReason != ErrTooDeep.Error() {
+		t.Errorf("TruncatedReason = %q, want %q", tree.TruncatedReason, ErrTooDeep)
+	}
+}
+
+func TestUnparsableMessagePart(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		content  string
+		limits   Limits
+		want     string
+		reason   error
+	}{
+		{
+			name:    "kept",
+			content: "not a message\r\n",
+			want:    "not a message\r\n",
+		},
+		{
+			name:     "decoded",
+			encoding: "base64",
+			content:  "bm90IGEgbWVzc2FnZQ0K",
+			want:     "not a message\r\n",
+		},
+		{
+			name:    "cut",
+			content: "not a message " + strings.Repeat("x", 1000),
+			limits:  Limits{MaxDecodedSize: 100},
+			want:    "not a message " + strings.Repeat("x", 86),
+			reason:  ErrDecodedTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := "Content-Type: message/rfc822\r\n"
+			if tt.encoding != "" {
+				part += "Content-Transfer-Encoding: " + tt.encoding + "\r\n"
+			}
+			m, err := readMessage(strings.NewReader(multipartMessage(part+"\r\n"+tt.content)), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := ParseMimeTreeLimits(m, tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaves := tree.Leaves()
+			if len(leaves) != 1 || leaves[0].Content != tt.want {
+				t.Fatalf("leaves = %+v, want one holding %q", leaves, tt.want)
+			}
+			reason := ""
+			if tt.reason != nil {
+				reason = tt.reason.Error()
+			}
+			if tree.TruncatedReason != reason {
+				t.Errorf("TruncatedReason = %q, want %q", tree.TruncatedReason, reason)
+			}
+		})
+	}
+}
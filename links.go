@@ -0,0 +1,340 @@
+package mailreader
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Link is a link found in the body of a message.
+type Link struct {
+	// URL is the target of the link, redirect wrappers removed.
+	URL string `json:"url"`
+	// Wrapped is the link as written in the message, when it was a
+	// redirect wrapper.
+	Wrapped string `json:"wrapped,omitempty"`
+	// Text is the anchor text of HTML links.
+	Text string `json:"text,omitempty"`
+	// Part is the path of the part holding the link, see MimePart.
+	Part string `json:"part"`
+}
+
+// LinkOptions tunes link extraction.
+type LinkOptions struct {
+	// Domains keeps the links to these domains and their subdomains. All
+	// links are kept when empty.
+	Domains []string
+}
+
+// matchDomain reports whether host is one of the domains, or a subdomain.
+func (o *LinkOptions) matchDomain(host string) bool {
+	if len(o.Domains) == 0 {
+		return true
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range o.Domains {
+		d = strings.TrimPrefix(strings.ToLower(d), ".")
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Links returns the links of the text and HTML parts of the message.
+func (m *ImapMail) Links(opts LinkOptions) []Link {
+	var links []Link
+	for _, p := range m.Parts {
+		links = append(links, extractLinks(p.Path, p.ContentType, p.Content, &opts)...)
+	}
+	return dedupLinks(links)
+}
+
+// Links returns the links of the text and HTML parts of the message.
+func (m *Pop3Mail) Links(opts LinkOptions) []Link {
+	var links []Link
+	for _, p := range m.Parts {
+		links = append(links, extractLinks(p.Path, p.ContentType, p.Content, &opts)...)
+	}
+	return dedupLinks(links)
+}
+
+// ExtractLinks returns the links of a body of the given content type,
+// text/html or text/plain.
+func ExtractLinks(contentType, body string, opts LinkOptions) []Link {
+	return dedupLinks(extractLinks("", contentType, body, &opts))
+}
+
+func extractLinks(path, contentType, body string, opts *LinkOptions) []Link {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var found []Link
+	switch mediaType {
+	case "text/html":
+		found = htmlLinks(body)
+	case "text/plain", "":
+		for _, u := range textURLRe.FindAllString(body, -1) {
+			found = append(found, Link{URL: trimURL(u)})
+		}
+	}
+
+	var links []Link
+	for _, l := range found {
+		l.Part = path
+		if !l.unwrap(opts) {
+			continue
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// textURLRe matches the URLs of plain text.
+var textURLRe = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'\[\]{}|\\^]+`)
+
+// trimURL removes the punctuation a sentence adds after a URL, closing
+// parentheses included unless the URL opened them.
+func trimURL(u string) string {
+	for {
+		trimmed := strings.TrimRight(u, ".,;:!?'\"")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == u {
+			return u
+		}
+		u = trimmed
+	}
+}
+
+// htmlLinks returns the anchors and image map areas of an HTML document.
+func htmlLinks(body string) []Link {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	var links []Link
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.DataAtom == atom.A || n.DataAtom == atom.Area) {
+			if href := strings.TrimSpace(attr(n, "href")); href != "" {
+				links = append(links, Link{URL: href, Text: anchorText(n)})
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return links
+}
+
+// anchorText returns the text of n, or the alt text of its images.
+func anchorText(n *html.Node) string {
+	var words []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			words = append(words, strings.Fields(zeroWidthRe.ReplaceAllString(n.Data, ""))...)
+		case n.Type == html.ElementNode && n.DataAtom == atom.Img:
+			words = append(words, strings.Fields(attr(n, "alt"))...)
+		case n.Type == html.ElementNode && (n.DataAtom == atom.Script || n.DataAtom == atom.Style):
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	if len(words) == 0 && n.DataAtom == atom.Area {
+		return attr(n, "alt")
+	}
+	return strings.Join(words, " ")
+}
+
+// unwrap removes the redirect wrappers of l and reports whether l is an
+// HTTP link the options keep.
+func (l *Link) unwrap(opts *LinkOptions) bool {
+	raw := l.URL
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	// wrappers can be nested, a SafeLink of a Proofpoint link for instance
+	for i := 0; i < 5; i++ {
+		target, ok := unwrapURL(u)
+		if !ok {
+			break
+		}
+		t, err := url.Parse(target)
+		if err != nil || t.Host == "" {
+			break
+		}
+		u = t
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	l.URL = u.String()
+	if l.URL != raw {
+		l.Wrapped = raw
+	}
+
+	host := u.Hostname()
+	if d := mimecastDomain(u); d != "" {
+		// the target of these is only known to Mimecast
+		host = d
+	}
+	return opts.matchDomain(host)
+}
+
+// unwrapURL returns the target of the redirect wrapper u.
+func unwrapURL(u *url.URL) (string, bool) {
+	host := strings.ToLower(u.Hostname())
+	q := u.Query()
+
+	switch {
+	// Outlook SafeLinks, https://eur01.safelinks.protection.outlook.com/?url=...
+	case strings.HasSuffix(host, ".safelinks.protection.outlook.com"):
+		return nonEmpty(q.Get("url"))
+
+	// Google redirects, https://www.google.com/url?q=...
+	case isGoogleHost(host) && u.Path == "/url":
+		if t := q.Get("q"); t != "" {
+			return t, true
+		}
+		return nonEmpty(q.Get("url"))
+
+	// Proofpoint URL Defense
+	case host == "urldefense.proofpoint.com" || host == "urldefense.com":
+		return unwrapProofpoint(u)
+
+	// Mimecast links carrying their target, most only know a token
+	case strings.HasSuffix(host, ".mimecast.com") || strings.HasSuffix(host, ".mimecastprotect.com"):
+		return nonEmpty(q.Get("url"))
+	}
+
+	return "", false
+}
+
+func nonEmpty(s string) (string, bool) {
+	return s, s != ""
+}
+
+func isGoogleHost(host string) bool {
+	host = strings.TrimPrefix(host, "www.")
+	return strings.HasPrefix(host, "google.") && strings.Count(host, ".") <= 2
+}
+
+// mimecastDomain returns the domain Mimecast protected links name, their
+// target itself being kept by Mimecast.
+func mimecastDomain(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	if !strings.HasSuffix(host, ".mimecast.com") && !strings.HasSuffix(host, ".mimecastprotect.com") {
+		return ""
+	}
+	return u.Query().Get("domain")
+}
+
+// proofpointRuns maps the run length characters of Proofpoint v3 URLs to
+// the number of characters they stand for.
+var proofpointRuns = func() map[byte]int {
+	runs := make(map[byte]int)
+	for i, c := range []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") {
+		runs[c] = i + 2
+	}
+	return runs
+}()
+
+// unwrapProofpoint decodes the three versions of Proofpoint URL Defense
+// links.
+func unwrapProofpoint(u *url.URL) (string, bool) {
+	switch {
+	case strings.HasPrefix(u.Path, "/v1/"):
+		return nonEmpty(u.Query().Get("u"))
+
+	case strings.HasPrefix(u.Path, "/v2/"):
+		// https-3A__example.com_path: "-" escapes hex, "_" is "/"
+		enc := u.Query().Get("u")
+		enc = strings.ReplaceAll(strings.ReplaceAll(enc, "-", "%"), "_", "/")
+		t, err := url.PathUnescape(enc)
+		if err != nil {
+			return "", false
+		}
+		return nonEmpty(t)
+
+	case strings.HasPrefix(u.EscapedPath(), "/v3/__"):
+		// /v3/__https://example.com/a*b__;Pw!!token: the characters
+		// replaced by "*" follow, base64 encoded
+		rest := strings.TrimPrefix(u.EscapedPath(), "/v3/__")
+		if u.RawQuery != "" {
+			rest += "?" + u.RawQuery
+		}
+		if u.Fragment != "" {
+			rest += "#" + u.EscapedFragment()
+		}
+
+		target, tail, ok := strings.Cut(rest, "__;")
+		if !ok {
+			target, _, ok = strings.Cut(rest, "__")
+			return target, ok && target != ""
+		}
+
+		enc, _, _ := strings.Cut(tail, "!")
+		dec, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(enc, "="))
+		if err != nil {
+			return "", false
+		}
+		chars := []rune(string(dec))
+
+		var b strings.Builder
+		for i := 0; i < len(target); i++ {
+			if target[i] != '*' {
+				b.WriteByte(target[i])
+				continue
+			}
+
+			n := 1
+			if i+2 < len(target) && target[i+1] == '*' {
+				n = proofpointRuns[target[i+2]]
+				i += 2
+			}
+			if n == 0 || n > len(chars) {
+				return "", false
+			}
+			b.WriteString(string(chars[:n]))
+			chars = chars[n:]
+		}
+		return b.String(), true
+	}
+
+	return "", false
+}
+
+// dedupLinks drops the links found twice in the same part.
+func dedupLinks(links []Link) []Link {
+	type key struct{ url, part string }
+
+	seen := make(map[key]bool)
+	out := links[:0]
+	for _, l := range links {
+		k := key{l.URL, l.Part}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, l)
+	}
+	return out
+}
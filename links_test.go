@@ -0,0 +1,242 @@
+package mailreader
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestUnwrapProofpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		ok   bool
+	}{
+		{
+			name: "v1",
+			in:   "https://urldefense.proofpoint.com/v1/url?u=https://example.com/a?b%3Dc&k=key",
+			want: "https://example.com/a?b=c",
+			ok:   true,
+		},
+		{
+			name: "v2",
+			in:   "https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_path_page-3Fx-3D1&d=DwMF&c=abc",
+			want: "https://example.com/path/page?x=1",
+			ok:   true,
+		},
+		{
+			name: "v2 bad escape",
+			in:   "https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_-ZZ",
+		},
+		{
+			name: "v3 plain",
+			in:   "https://urldefense.com/v3/__https://example.com/path__;!!token",
+			want: "https://example.com/path",
+			ok:   true,
+		},
+		{
+			name: "v3 without replacements",
+			in:   "https://urldefense.com/v3/__https://example.com/path__",
+			want: "https://example.com/path",
+			ok:   true,
+		},
+		{
+			name: "v3 replaced character",
+			in:   "https://urldefense.com/v3/__https://example.com/a*b__;Pw!!token",
+			want: "https://example.com/a?b",
+			ok:   true,
+		},
+		{
+			name: "v3 replaced run",
+			in:   "https://urldefense.com/v3/__https://example.com/a**Ab__;Pz0!!token",
+			want: "https://example.com/a?=b",
+			ok:   true,
+		},
+		{
+			name: "v3 replaced non ascii",
+			in:   "https://urldefense.com/v3/__https://example.com/caf*__;w6k!!token",
+			want: "https://example.com/café",
+			ok:   true,
+		},
+		{
+			name: "v3 missing replacements",
+			in:   "https://urldefense.com/v3/__https://example.com/a*b*c__;Pw!!token",
+		},
+		{
+			name: "unknown version",
+			in:   "https://urldefense.com/v4/url?u=https://example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := unwrapProofpoint(u)
+			if ok != tt.ok || ok && got != tt.want {
+				t.Errorf("unwrapProofpoint(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLinkUnwrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		domains []string
+		want    string
+		keep    bool
+	}{
+		{
+			name: "plain",
+			in:   "https://example.com/a",
+			want: "https://example.com/a",
+			keep: true,
+		},
+		{
+			name: "safelinks",
+			in:   "https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fverify%3Ft%3D1&data=x&reserved=0",
+			want: "https://example.com/verify?t=1",
+			keep: true,
+		},
+		{
+			name: "google q",
+			in:   "https://www.google.com/url?q=https://example.com/a&sa=D",
+			want: "https://example.com/a",
+			keep: true,
+		},
+		{
+			name: "google url",
+			in:   "https://google.co.uk/url?url=https://example.com/a",
+			want: "https://example.com/a",
+			keep: true,
+		},
+		{
+			name: "google search is no wrapper",
+			in:   "https://www.google.com/search?q=https://example.com/a",
+			want: "https://www.google.com/search?q=https://example.com/a",
+			keep: true,
+		},
+		{
+			name: "mimecast with target",
+			in:   "https://protect-eu.mimecast.com/s/abc?url=https://example.com/a",
+			want: "https://example.com/a",
+			keep: true,
+		},
+		{
+			name:    "mimecast token only",
+			in:      "https://protect-eu.mimecast.com/s/abc?domain=example.com",
+			domains: []string{"example.com"},
+			want:    "https://protect-eu.mimecast.com/s/abc?domain=example.com",
+			keep:    true,
+		},
+		{
+			name: "nested",
+			in:   "https://eur01.safelinks.protection.outlook.com/?url=" + url.QueryEscape("https://urldefense.com/v3/__https://example.com/a__;!!t"),
+			want: "https://example.com/a",
+			keep: true,
+		},
+		{
+			name:    "subdomain kept",
+			in:      "https://www.google.com/url?q=https://mail.example.com/a",
+			domains: []string{"example.com"},
+			want:    "https://mail.example.com/a",
+			keep:    true,
+		},
+		{
+			name:    "other domain dropped",
+			in:      "https://www.google.com/url?q=https://example.org/a",
+			domains: []string{"example.com"},
+		},
+		{
+			name:    "suffix is no subdomain",
+			in:      "https://notexample.com/a",
+			domains: []string{"example.com"},
+		},
+		{
+			name: "mailto dropped",
+			in:   "mailto:someone@example.com",
+		},
+		{
+			name: "javascript target left wrapped",
+			in:   "https://www.google.com/url?q=javascript:alert(1)",
+			want: "https://www.google.com/url?q=javascript:alert(1)",
+			keep: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := Link{URL: tt.in}
+			keep := l.unwrap(&LinkOptions{Domains: tt.domains})
+			if keep != tt.keep {
+				t.Fatalf("unwrap(%q) = %v, want %v", tt.in, keep, tt.keep)
+			}
+			if !keep {
+				return
+			}
+			if l.URL != tt.want {
+				t.Errorf("URL = %q, want %q", l.URL, tt.want)
+			}
+			if wrapped := tt.want != tt.in; wrapped != (l.Wrapped == tt.in) {
+				t.Errorf("Wrapped = %q", l.Wrapped)
+			}
+		})
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []Link
+	}{
+		{
+			name:        "text",
+			contentType: "text/plain; charset=utf-8",
+			body:        "See https://example.com/a. Or (https://example.com/b) and https://example.com/wiki/Go_(language)!",
+			want: []Link{
+				{URL: "https://example.com/a"},
+				{URL: "https://example.com/b"},
+				{URL: "https://example.com/wiki/Go_(language)"},
+			},
+		},
+		{
+			name:        "html",
+			contentType: "text/html",
+			body:        `<a href="https://example.com/a">Verify <b>now</b></a><a href="https://example.com/b"><img alt="Logo"></a><a href="mailto:x@example.com">mail</a><a href="https://example.com/a">again</a>`,
+			want: []Link{
+				{URL: "https://example.com/a", Text: "Verify now"},
+				{URL: "https://example.com/b", Text: "Logo"},
+			},
+		},
+		{
+			name:        "image map",
+			contentType: "text/html",
+			body:        `<map><area href="https://example.com/c" alt="Area"></map>`,
+			want:        []Link{{URL: "https://example.com/c", Text: "Area"}},
+		},
+		{
+			name:        "other type",
+			contentType: "application/pdf",
+			body:        "https://example.com/a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractLinks(tt.contentType, tt.body, LinkOptions{})
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractLinks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package mailreader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// MimePart is a node of the MIME tree of a message.
+type MimePart struct {
+	// Path locates the part the way IMAP numbers body sections: "1.2" is
+	// the second part of the first part. A multipart message root has an
+	// empty path, the body of a single part message is "1".
+	Path string `json:"path"`
+	// ContentType is the media type, lowercased, "text/plain" by default.
+	ContentType string            `json:"content_type"`
+	Params      map[string]string `json:"params,omitempty"`
+	// Disposition is "inline", "attachment" or empty.
+	Disposition       string            `json:"disposition,omitempty"`
+	DispositionParams map[string]string `json:"disposition_params,omitempty"`
+	// Filename is the decoded name of an attached file.
+	Filename string               `json:"filename,omitempty"`
+	Header   textproto.MIMEHeader `json:"header,omitempty"`
+	// Charset is the charset the part declared. Content of text parts is
+	// converted from it to UTF-8 whenever it is known.
+	Charset string `json:"charset,omitempty"`
+	// Content is the body of a leaf part, transfer encoding removed.
+	Content  string      `json:"content,omitempty"`
+	Children []*MimePart `json:"children,omitempty"`
+	// Truncated is set on the root when a limit cut the tree short, the
+	// reason telling which.
+	Truncated       bool   `json:"truncated,omitempty"`
+	TruncatedReason string `json:"truncated_reason,omitempty"`
+}
+
+// IsMultipart reports whether the part is a container of other parts.
+func (p *MimePart) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// Leaves returns the parts holding content, in the order of the message.
+func (p *MimePart) Leaves() []*MimePart {
+	if len(p.Children) == 0 {
+		return []*MimePart{p}
+	}
+
+	var leaves []*MimePart
+	for _, c := range p.Children {
+		leaves = append(leaves, c.Leaves()...)
+	}
+	return leaves
+}
+
+// ParseMimeTree walks the whole MIME structure of m, multipart containers
+// and attached messages included. Parts that cannot be parsed are kept as
+// leaves holding their raw content. DefaultLimits apply.
+func ParseMimeTree(m *mail.Message) (*MimePart, error) {
+	return ParseMimeTreeLimits(m, DefaultLimits)
+}
+
+// ParseMimeTreeLimits is ParseMimeTree within limits. The walk stops at the
+// first limit broken, the tree then holds what was read and its root is
+// marked Truncated. MaxMessageSize is left to the caller.
+func ParseMimeTreeLimits(m *mail.Message, limits Limits) (*MimePart, error) {
+	w := &mimeWalker{limits: limits.withDefaults()}
+	return w.parse(m)
+}
+
+// mimeWalker builds MIME trees. With leaf set, the leaf bodies are handed
+// to it as they are read, transfer encoding removed, instead of being kept
+// in Content.
+type mimeWalker struct {
+	leaf   func(p *MimePart, body io.Reader) error
+	limits Limits
+
+	parts   int
+	decoded int64
+	// truncated is the first limit broken
+	truncated error
+}
+
+// parse walks the message m and marks the root with the limit broken.
+func (w *mimeWalker) parse(m *mail.Message) (*MimePart, error) {
+	p, err := w.walk(textproto.MIMEHeader(m.Header), m.Body, "", 0, true)
+	if p != nil && w.truncated != nil {
+		p.Truncated, p.TruncatedReason = true, w.truncated.Error()
+	}
+	return p, err
+}
+
+func (w *mimeWalker) truncate(reason error) {
+	if w.truncated == nil {
+		w.truncated = reason
+	}
+}
+
+// tooManyParts reports whether more parts were met than MaxParts allows.
+func (w *mimeWalker) tooManyParts() bool {
+	return w.limits.MaxParts > 0 && w.parts > w.limits.MaxParts
+}
+
+// deeper reports whether the parts at depth can be walked into.
+func (w *mimeWalker) deeper(depth int) bool {
+	return w.limits.MaxDepth <= 0 || depth < w.limits.MaxDepth
+}
+
+// walk parses the entity made of h and body found at path base. root is
+// set for the header of a whole message, top level or attached.
+func (w *mimeWalker) walk(h textproto.MIMEHeader, body io.Reader, base string, depth int, root bool) (*MimePart, error) {
+	w.parts++
+	if w.tooManyParts() {
+		w.truncate(ErrTooManyParts)
+		return nil, nil
+	}
+
+	p := newMimePart(h, base)
+	nested := p.IsMultipart() && p.Params["boundary"] != "" || p.ContentType == "message/rfc822"
+	if nested && !w.deeper(depth) {
+		// kept as a leaf of raw content
+		w.truncate(ErrTooDeep)
+		nested = false
+	}
+
+	switch {
+	case nested && p.IsMultipart():
+		mr := multipart.NewReader(body, p.Params["boundary"])
+		for i := 1; ; i++ {
+			// raw parts keep their transfer encoding, decoded below
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return p, fmt.Errorf("part %v: %w", joinPath(base, i), err)
+			}
+			if limit := w.limits.MaxHeaderSize; limit > 0 && headerSize(part.Header) > limit {
+				w.truncate(ErrHeaderTooLarge)
+				continue
+			}
+
+			child, err := w.walk(part.Header, part, joinPath(base, i), depth+1, false)
+			if child != nil {
+				p.Children = append(p.Children, child)
+			}
+			if err != nil {
+				return p, err
+			}
+			if w.tooManyParts() {
+				break
+			}
+		}
+		return p, nil
+
+	case nested:
+		// keep what parsing the header reads, in case it is not a message
+		head := &headCapture{}
+		tee := transferReader(h.Get("Content-Transfer-Encoding"), io.TeeReader(body, head))
+
+		inner, err := readMessage(tee, w.limits.MaxHeaderSize)
+		head.done = true
+		if errors.Is(err, ErrHeaderTooLarge) {
+			w.truncate(err)
+			err = nil
+		}
+		if err != nil {
+			// not a message after all, keep it as is, within the limits
+			b, err := w.readContent(h, io.MultiReader(bytes.NewReader(head.buf.Bytes()), body))
+			if cerr := w.content(p, b); err == nil {
+				err = cerr
+			}
+			return p, err
+		}
+
+		child, err := w.walk(textproto.MIMEHeader(inner.Header), inner.Body, base, depth+1, true)
+		if child != nil {
+			p.Children = append(p.Children, child)
+		}
+		return p, err
+	}
+
+	if root {
+		// the body of a single part message
+		p.Path = joinPath(base, 1)
+	}
+
+	if strings.HasPrefix(p.ContentType, "text/") {
+		p.Charset = strings.ToLower(p.Params["charset"])
+	}
+	if w.leaf != nil {
+		return p, w.leaf(p, transferReader(h.Get("Content-Transfer-Encoding"), body))
+	}
+
+	b, err := w.readContent(h, body)
+	if cerr := w.content(p, b); err == nil {
+		err = cerr
+	}
+	return p, err
+}
+
+// newMimePart describes the entity of header h found at path, but for its
+// charset and content.
+func newMimePart(h textproto.MIMEHeader, path string) *MimePart {
+	p := &MimePart{
+		Path:        path,
+		ContentType: "text/plain",
+		Header:      h,
+	}
+
+	if ct := h.Get("Content-Type"); ct != "" {
+		mediaType, params, err := mime.ParseMediaType(ct)
+		if err == nil || errors.Is(err, mime.ErrInvalidMediaParameter) {
+			p.ContentType, p.Params = mediaType, params
+		}
+	}
+	if cd := h.Get("Content-Disposition"); cd != "" {
+		disposition, params, err := mime.ParseMediaType(cd)
+		if err == nil || errors.Is(err, mime.ErrInvalidMediaParameter) {
+			p.Disposition, p.DispositionParams = disposition, params
+		}
+	}
+	p.Filename = mimeFilename(p)
+	return p
+}
+
+// content sets the decoded content b of the leaf p.
+func (w *mimeWalker) content(p *MimePart, b []byte) error {
+	if w.leaf != nil {
+		return w.leaf(p, bytes.NewReader(b))
+	}
+
+	// attached files are kept byte for byte
+	if p.Charset != "" && !p.IsAttachment() {
+		b = toUTF8(p.Charset, b)
+	}
+	p.Content = string(b)
+	return nil
+}
+
+// headCapture keeps what is written to it until done is set.
+type headCapture struct {
+	buf  bytes.Buffer
+	done bool
+}
+
+func (c *headCapture) Write(b []byte) (int, error) {
+	if !c.done {
+		c.buf.Write(b)
+	}
+	return len(b), nil
+}
+
+// readContent reads body and removes the transfer encoding h declares.
+// Content that fails to decode is kept as sent. What is kept counts against
+// MaxDecodedSize, the content over it is cut.
+func (w *mimeWalker) readContent(h textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	budget, rawMax := int64(-1), int64(-1)
+	if limit := w.limits.MaxDecodedSize; limit > 0 {
+		budget = max(0, limit-w.decoded)
+		// quoted-printable takes up to three octets per decoded one
+		rawMax = 3*budget + 4096
+		body = io.LimitReader(body, rawMax+1)
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return raw, err
+	}
+	if rawMax >= 0 && int64(len(raw)) > rawMax {
+		w.truncate(ErrDecodedTooLarge)
+		raw = raw[:rawMax]
+	}
+
+	b, err := decodeTransfer(h.Get("Content-Transfer-Encoding"), raw)
+	if err != nil {
+		b = raw
+	}
+	if budget >= 0 && int64(len(b)) > budget {
+		w.truncate(ErrDecodedTooLarge)
+		b = b[:budget]
+	}
+	w.decoded += int64(len(b))
+	return b, nil
+}
+
+func joinPath(base string, i int) string {
+	if base == "" {
+		return fmt.Sprint(i)
+	}
+	return fmt.Sprintf("%v.%d", base, i)
+}
+
+// textCharset returns the charset of the first text leaf, the best guess
+// for headers sent unencoded.
+func (p *MimePart) textCharset() string {
+	for _, l := range p.Leaves() {
+		if l.Charset != "" {
+			return l.Charset
+		}
+	}
+	return ""
+}
+
+// partContentType returns the Content-Type header of p as sent, or its
+// media type when the header is missing.
+func partContentType(p *MimePart) string {
+	if ct := p.Header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return p.ContentType
+}
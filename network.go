@@ -0,0 +1,122 @@
+package mailreader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/New-Moon-Team/gomailreader/proxy"
+)
+
+// NetOptions tunes the network dialer used when ReaderConfig.Dialer is nil.
+type NetOptions struct {
+	// LocalAddr is the source IP of outgoing connections, for hosts with
+	// several addresses.
+	LocalAddr string
+	// DialTimeout bounds establishing a TCP connection.
+	DialTimeout time.Duration
+	// KeepAlive is the TCP keepalive period, negative to disable it.
+	KeepAlive time.Duration
+	// DNSServer is the host:port of the DNS server to query instead of the
+	// system resolver.
+	DNSServer string
+	// Hosts maps host names to an IP, or an IP and port, bypassing DNS.
+	// Mostly meant to point tests to local servers.
+	Hosts map[string]string
+}
+
+// netDialer returns the dialer reaching the server, or the first proxy.
+func (c *ReaderConfig) netDialer() (proxy.ContextDialer, error) {
+	if c.Dialer != nil {
+		return c.Dialer, nil
+	}
+
+	o := c.Net
+	if o == nil {
+		return proxy.Direct, nil
+	}
+
+	d := &net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: o.KeepAlive,
+	}
+	if o.LocalAddr != "" {
+		ip := net.ParseIP(o.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: local address %q", ErrInvalidNetOptions, o.LocalAddr)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if o.DNSServer != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dns := &net.Dialer{Timeout: o.DialTimeout}
+				if o.LocalAddr != "" {
+					dns.LocalAddr = d.LocalAddr
+					if network == "udp" || network == "udp4" || network == "udp6" {
+						dns.LocalAddr = &net.UDPAddr{IP: d.LocalAddr.(*net.TCPAddr).IP}
+					}
+				}
+				return dns.DialContext(ctx, network, o.DNSServer)
+			},
+		}
+	}
+
+	return &localDialer{Dialer: d, hosts: o.Hosts}, nil
+}
+
+// localDialer dials with d, rewriting the addresses of the hosts it knows.
+// It also resolves the targets of socks5 proxies the same way, see
+// proxy.Resolver.
+type localDialer struct {
+	*net.Dialer
+	hosts map[string]string
+}
+
+func (d *localDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if to, ok := d.hosts[host]; ok {
+			addr = to
+			if _, _, err := net.SplitHostPort(to); err != nil {
+				addr = net.JoinHostPort(to, port)
+			}
+		}
+	}
+
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+// LookupIPAddr resolves host with Hosts, the port of their entries being
+// lost, or the DNS server of NetOptions.
+func (d *localDialer) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if to, ok := d.hosts[host]; ok {
+		if h, _, err := net.SplitHostPort(to); err == nil {
+			to = h
+		}
+		if ip := net.ParseIP(to); ip != nil {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		host = to
+	}
+
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return r.LookupIPAddr(ctx, host)
+}
+
+// dial connects to addr through the proxies of the account.
+func (c *ReaderConfig) dial(ctx context.Context, addr string) (net.Conn, error) {
+	d, err := c.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, "tcp", addr)
+	}
+	return d.Dial("tcp", addr)
+}
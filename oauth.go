@@ -0,0 +1,194 @@
+package mailreader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/New-Moon-Team/gomailreader/secret"
+
+	"github.com/emersion/go-sasl"
+)
+
+var (
+	GoogleTokenURL    = "https://oauth2.googleapis.com/token"
+	MicrosoftTokenURL = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+)
+
+// tokenExpiryDelta is how long before its expiry a token is refreshed.
+const tokenExpiryDelta = 30 * time.Second
+
+// Token is an OAuth2 access token.
+type Token struct {
+	AccessToken string
+	// Expiry is zero for tokens that never expire.
+	Expiry time.Time
+}
+
+// Valid reports whether the token can still be used for a while.
+func (t *Token) Valid() bool {
+	if t == nil || t.AccessToken == "" {
+		return false
+	}
+	return t.Expiry.IsZero() || time.Until(t.Expiry) > tokenExpiryDelta
+}
+
+// String describes the token without its value.
+func (t *Token) String() string {
+	return fmt.Sprintf("token expiring %v", t.Expiry)
+}
+
+// TokenSource hands out valid access tokens, refreshing them as needed.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// StaticTokenSource always returns the same access token.
+type StaticTokenSource struct {
+	AccessToken string
+}
+
+func (s *StaticTokenSource) Token(ctx context.Context) (*Token, error) {
+	return &Token{AccessToken: s.AccessToken}, nil
+}
+
+// SecretTokenSource reads the access token from a secret source, for tokens
+// refreshed by another process.
+type SecretTokenSource struct {
+	Source secret.Source
+}
+
+func (s *SecretTokenSource) Token(ctx context.Context) (*Token, error) {
+	v, err := s.Source.Secret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{AccessToken: v}, nil
+}
+
+// TokenError is an error response of a token endpoint.
+type TokenError struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("token endpoint: %d %s: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// RefreshTokenSource exchanges a refresh token for access tokens at
+// TokenURL, typically GoogleTokenURL or MicrosoftTokenURL. Tokens are cached
+// until they are about to expire.
+type RefreshTokenSource struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	// ClientSecretFrom and RefreshTokenFrom, when set, are resolved on every
+	// refresh and used instead of ClientSecret and RefreshToken.
+	ClientSecretFrom secret.Source
+	RefreshTokenFrom secret.Source
+	Scopes           []string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu    sync.Mutex
+	token *Token
+}
+
+func (s *RefreshTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.Valid() {
+		return s.token, nil
+	}
+
+	refreshToken, err := secret.Resolve(ctx, s.RefreshTokenFrom, s.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := secret.Resolve(ctx, s.ClientSecretFrom, s.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {s.ClientID},
+	}
+	if clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	hc := s.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, &TokenError{StatusCode: resp.StatusCode, Code: body.Error, Description: body.ErrorDescription}
+	}
+
+	t := &Token{AccessToken: body.AccessToken}
+	if body.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	if body.RefreshToken != "" {
+		// Microsoft rotates refresh tokens, the new one wins over the source
+		s.RefreshToken = body.RefreshToken
+		s.RefreshTokenFrom = nil
+	}
+	s.token = t
+
+	return t, nil
+}
+
+// oauthClient returns the SASL client of mech, XOAUTH2 unless mech is
+// AuthOAuthBearer.
+func oauthClient(mech AuthMechanism, user, token, host string, port int) sasl.Client {
+	if mech == AuthOAuthBearer {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: user,
+			Token:    token,
+			Host:     host,
+			Port:     port,
+		})
+	}
+
+	return newXOAuth2Client(user, token)
+}
@@ -0,0 +1,253 @@
+package mailreader
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+var apopTimestampRe = regexp.MustCompile(`<[^<>]+@[^<>]+>`)
+
+// capa fetches the capabilities of the server. Servers predating CAPA answer
+// -ERR, they are left with no capability.
+func (s *pop3Session) capa() error {
+	s.caps = make(map[string][]string)
+
+	lines, err := s.lines("CAPA")
+	if err != nil {
+		if _, ok := err.(pop3Err); ok {
+			return nil
+		}
+		return err
+	}
+
+	for _, l := range lines {
+		f := strings.Fields(l)
+		if len(f) > 0 {
+			s.caps[strings.ToUpper(f[0])] = f[1:]
+		}
+	}
+
+	return nil
+}
+
+func (s *pop3Session) hasCap(name string) bool {
+	_, ok := s.caps[name]
+	return ok
+}
+
+func (s *pop3Session) hasSASL(mech AuthMechanism) bool {
+	for _, m := range s.caps["SASL"] {
+		if strings.EqualFold(m, string(mech)) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTLS upgrades the connection with STLS and fetches the capabilities
+// again, as they may differ once the connection is protected.
+func (s *pop3Session) startTLS(cfg *tls.Config) error {
+	if !s.hasCap("STLS") {
+		return ErrStartTLSNotSupported
+	}
+
+	if _, err := s.cmd("STLS"); err != nil {
+		return err
+	}
+
+	conn := tls.Client(s.conn, cfg)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	// STLS is not followed by a new greeting, give the client a fake one
+	if err := s.reset(conn, "+OK"); err != nil {
+		return err
+	}
+
+	return s.capa()
+}
+
+// pickAuth returns the mechanisms usable with a password, in the order they
+// are tried. Without TLS, APOP comes first when the greeting offers it so the
+// password does not cross the network in clear. Over TLS it is left out: it
+// relies on MD5 and servers often keep its secret apart from the login
+// password, it must then be asked for with Auth.
+func (s *pop3Session) pickAuth() []AuthMechanism {
+	var mechs []AuthMechanism
+	if _, secure := s.conn.(*tls.Conn); !secure && apopTimestampRe.MatchString(s.greeting) {
+		mechs = append(mechs, AuthAPOP)
+	}
+	if s.hasSASL(AuthPlain) {
+		mechs = append(mechs, AuthPlain)
+	}
+	if s.hasSASL(AuthLogin) {
+		mechs = append(mechs, AuthLogin)
+	}
+	return append(mechs, AuthUser)
+}
+
+// pickOAuth returns the OAuth2 mechanism to use, XOAUTH2 when in doubt.
+func (s *pop3Session) pickOAuth() AuthMechanism {
+	if !s.hasSASL(AuthXOAuth2) && s.hasSASL(AuthOAuthBearer) {
+		return AuthOAuthBearer
+	}
+	return AuthXOAuth2
+}
+
+// login authenticates as configured by cfg. With AuthXOAuth2 and no token
+// source the password is used as the access token.
+func (s *pop3Session) login(ctx context.Context, cfg *ReaderConfig) error {
+	user, mech := cfg.User, cfg.Auth
+
+	if cfg.TokenSource != nil {
+		t, err := cfg.TokenSource.Token(ctx)
+		if err != nil {
+			return err
+		}
+		if mech == "" {
+			mech = s.pickOAuth()
+		}
+		return s.authenticate(oauthClient(mech, user, t.AccessToken, string(cfg.Server), cfg.port(995, 110)))
+	}
+
+	password, err := cfg.password(ctx)
+	if err != nil {
+		return err
+	}
+
+	if mech != "" {
+		return s.passwordLogin(mech, cfg, password)
+	}
+
+	// the next mechanism is tried only when the server refuses one before
+	// the credentials are sent: refused credentials are not sent again, as
+	// repeated failures may lock the account
+	for _, mech := range s.pickAuth() {
+		err = s.passwordLogin(mech, cfg, password)
+		var rerr rejectedMech
+		if !errors.As(err, &rerr) {
+			return err
+		}
+	}
+	return err
+}
+
+// rejectedMech is the -ERR of a server refusing a mechanism before any
+// credential was sent.
+type rejectedMech struct {
+	err error
+}
+
+func (e rejectedMech) Error() string { return e.err.Error() }
+func (e rejectedMech) Unwrap() error { return e.err }
+
+// rejected marks a -ERR answered before the credentials were sent.
+func rejected(err error) error {
+	var perr pop3Err
+	if errors.As(err, &perr) {
+		return rejectedMech{err}
+	}
+	return err
+}
+
+// passwordLogin authenticates with mech and a password.
+func (s *pop3Session) passwordLogin(mech AuthMechanism, cfg *ReaderConfig, password string) error {
+	user := cfg.User
+
+	switch mech {
+	case AuthUser:
+		if _, err := s.cmd("USER", user); err != nil {
+			return rejected(err)
+		}
+		_, err := s.cmd("PASS", password)
+		return err
+	case AuthAPOP:
+		return s.apop(user, password)
+	case AuthPlain:
+		return s.authenticate(&deferredClient{Client: sasl.NewPlainClient("", user, password)})
+	case AuthLogin:
+		return s.authenticate(newLoginClient(user, password))
+	case AuthXOAuth2, AuthOAuthBearer:
+		return s.authenticate(oauthClient(mech, user, password, string(cfg.Server), cfg.port(995, 110)))
+	}
+
+	return fmt.Errorf("%w: %v", ErrAuthNotSupported, mech)
+}
+
+// apop authenticates with the digest of the greeting timestamp and password.
+func (s *pop3Session) apop(user, password string) error {
+	ts := apopTimestampRe.FindString(s.greeting)
+	if ts == "" {
+		return fmt.Errorf("%w: %v", ErrAuthNotSupported, AuthAPOP)
+	}
+
+	sum := md5.Sum([]byte(ts + password))
+	_, err := s.cmd("APOP", user, hex.EncodeToString(sum[:]))
+	return err
+}
+
+// authenticate runs a SASL exchange as described by RFC 5034.
+func (s *pop3Session) authenticate(client sasl.Client) error {
+	mech, ir, err := client.Start()
+	if err != nil {
+		return err
+	}
+
+	line := "AUTH " + mech
+	if ir != nil {
+		if len(ir) == 0 {
+			line += " ="
+		} else {
+			line += " " + base64.StdEncoding.EncodeToString(ir)
+		}
+	}
+	if err := s.Writer.PrintfLine("%s", line); err != nil {
+		return err
+	}
+
+	// whether credentials were sent, a -ERR before means the mechanism is
+	// refused
+	answered := ir != nil
+	for {
+		resp, err := s.Reader.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(resp, "+ ") && resp != "+" {
+			_, err = pop3Status("AUTH", resp)
+			if !answered {
+				return rejected(err)
+			}
+			return err
+		}
+
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(resp, "+")))
+		if err != nil {
+			return err
+		}
+
+		answer, err := client.Next(challenge)
+		if err != nil {
+			// cancel the exchange, the server answers -ERR
+			s.Writer.PrintfLine("*")
+			s.Reader.ReadLine()
+			return err
+		}
+
+		if err := s.Writer.PrintfLine("%s", base64.StdEncoding.EncodeToString(answer)); err != nil {
+			return err
+		}
+		answered = true
+	}
+}
@@ -0,0 +1,133 @@
+package mailreader
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pop3Exchange is a command expected by a scripted server and its answer.
+type pop3Exchange struct {
+	cmd, reply string
+}
+
+// scriptedPop3 serves greeting then script on conn, reporting the first
+// unexpected command.
+func scriptedPop3(conn net.Conn, greeting string, script []pop3Exchange) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "%s\r\n", greeting)
+		for _, e := range script {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				done <- fmt.Errorf("waiting for %q: %v", e.cmd, err)
+				return
+			}
+			if got := strings.TrimRight(line, "\r\n"); got != e.cmd {
+				done <- fmt.Errorf("got %q, want %q", got, e.cmd)
+				return
+			}
+			fmt.Fprintf(conn, "%s\r\n", e.reply)
+		}
+		if line, err := r.ReadString('\n'); err == nil {
+			done <- fmt.Errorf("unexpected %q", strings.TrimRight(line, "\r\n"))
+			return
+		}
+		done <- nil
+	}()
+	return done
+}
+
+func TestPop3Login(t *testing.T) {
+	const stamp = "<1896.697170952@example.com>"
+	sum := md5.Sum([]byte(stamp + "secret"))
+	apop := "APOP user " + hex.EncodeToString(sum[:])
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+
+	tests := []struct {
+		name     string
+		greeting string
+		sasl     []string
+		script   []pop3Exchange
+		wantErr  bool
+	}{
+		{
+			name:     "apop without tls",
+			greeting: "+OK ready " + stamp,
+			sasl:     []string{"PLAIN"},
+			script:   []pop3Exchange{{apop, "+OK"}},
+		},
+		{
+			name:     "apop refused",
+			greeting: "+OK ready " + stamp,
+			sasl:     []string{"PLAIN"},
+			script:   []pop3Exchange{{apop, "-ERR [AUTH] invalid"}},
+			wantErr:  true,
+		},
+		{
+			name:     "plain",
+			greeting: "+OK ready",
+			sasl:     []string{"PLAIN"},
+			script:   []pop3Exchange{{"AUTH PLAIN", "+ "}, {plain, "+OK"}},
+		},
+		{
+			name:     "password refused",
+			greeting: "+OK ready",
+			sasl:     []string{"PLAIN", "LOGIN"},
+			script:   []pop3Exchange{{"AUTH PLAIN", "+ "}, {plain, "-ERR [AUTH] invalid"}},
+			wantErr:  true,
+		},
+		{
+			name:     "mechanism refused",
+			greeting: "+OK ready",
+			sasl:     []string{"PLAIN"},
+			script: []pop3Exchange{
+				{"AUTH PLAIN", "-ERR unknown mechanism"},
+				{"USER user", "+OK"},
+				{"PASS secret", "+OK"},
+			},
+		},
+		{
+			name:     "user refused",
+			greeting: "+OK ready",
+			script:   []pop3Exchange{{"USER user", "-ERR plaintext disabled"}},
+			wantErr:  true,
+		},
+		{
+			name:     "pass refused",
+			greeting: "+OK ready",
+			script:   []pop3Exchange{{"USER user", "+OK"}, {"PASS secret", "-ERR [AUTH] invalid"}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			done := scriptedPop3(server, tt.greeting, tt.script)
+
+			s, err := newPop3Session(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.caps = map[string][]string{"SASL": tt.sasl}
+
+			err = s.login(context.Background(), &ReaderConfig{User: "user", Password: "secret"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("login() error = %v, want error %v", err, tt.wantErr)
+			}
+			client.Close()
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
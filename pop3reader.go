@@ -1,19 +1,15 @@
 package mailreader
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"mime"
-	"mime/multipart"
+	"net/mail"
 	"strings"
 	"time"
-
-	"github.com/New-Moon-Team/gomailreader/proxy"
-
-	"github.com/denisss025/go-pop3-client"
 )
 
 type Pop3Reader struct {
@@ -24,8 +20,8 @@ func (r *Pop3Reader) BoxGetAll(mailbox MailBox, res *[]byte) error {
 	box := fmt.Sprintf("%v", mailbox)
 
 	switch r.Server {
-	case Pop3GmailServer:
-		mails, err := r.gmailBoxGetAll(box)
+	case Pop3GmailServer, Pop3HotmailServer:
+		mails, _, err := r.boxGetNew(box, nil)
 		if err != nil {
 			return err
 		}
@@ -34,240 +30,471 @@ func (r *Pop3Reader) BoxGetAll(mailbox MailBox, res *[]byte) error {
 			return err
 		}
 		*res = b
-	case Pop3HotmailServer:
-		mails, err := r.hotmailBoxGetAll(box)
+	default:
+		return ErrServerMailNotImplemented
+	}
+
+	return nil
+}
+
+// BoxGetNew retrieves only the messages whose UIDL is not in seen and
+// returns the updated set. UIDLs no longer on the server are dropped from
+// it, messages that could not be retrieved are left out to be retried.
+func (r *Pop3Reader) BoxGetNew(mailbox MailBox, seen UidlSet, res *[]byte) (UidlSet, error) {
+	box := fmt.Sprintf("%v", mailbox)
+
+	switch r.Server {
+	case Pop3GmailServer, Pop3HotmailServer:
+		if seen == nil {
+			seen = make(UidlSet)
+		}
+		mails, set, err := r.boxGetNew(box, seen)
 		if err != nil {
-			return err
+			return seen, err
 		}
 		b, err := json.Marshal(mails)
 		if err != nil {
-			return err
+			return seen, err
 		}
 		*res = b
-	default:
-		return ErrServerMailNotImplemented
+		return set, nil
 	}
 
-	return nil
+	return seen, ErrServerMailNotImplemented
 }
+
 func (r *Pop3Reader) GetAllBoxes() error {
 	fmt.Println("it works")
 	return nil
 }
+
+// GetLatestMsgOf stores into res the latest message sent to receiver in the
+// last five minutes, in the shape of the IMAP reader, see ImapShape.
 func (r *Pop3Reader) GetLatestMsgOf(ctx context.Context, res *[]byte, box, receiver string) error {
-	panic("implement me")
-}
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
 
-func (r *Pop3Reader) gmailBoxGetAll(box string) ([]Pop3Mail, error) {
-	r.log(fmt.Sprintf("Start reading box: %v", box))
+	pred := MessagePredicate{
+		Receiver: receiver,
+		After:    time.Now().Add(-5 * time.Minute),
+	}
 
-	var mails []Pop3Mail
+	err := r.WaitForMessage(ctx, res, box, pred, WaitOptions{})
+	if errors.Is(err, ErrWaitTimeout) || errors.Is(err, context.Canceled) {
+		// same behaviour as the IMAP reader
+		return nil
+	}
+
+	return err
+}
 
-	if r.Proxy == nil {
-		return mails, ErrNoProxy
+// WaitForMessage polls the mailbox until a message matching pred shows up and
+// stores it as JSON into res, in the shape of the IMAP reader like every
+// method of Reader, see ImapShape. A POP3 session does not see the messages
+// delivered after it started, so every poll opens a new one; only the headers
+// of messages not checked yet are downloaded with TOP, newest first, down to
+// the first one received before pred.After.
+//
+// POP3 has no flags: pred.Unseen and opts.MarkSeen have no effect. The date
+// of the topmost Received header, or else the Date header, stands for the
+// arrival time.
+func (r *Pop3Reader) WaitForMessage(ctx context.Context, res *[]byte, box string, pred MessagePredicate, opts WaitOptions) error {
+	if !r.hasRoute() {
+		return ErrNoProxy
 	}
 
-	d, err := proxy.NewHTTPDialer(r.Proxy)
-	if err != nil {
-		return mails, err
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
 
-	addr := fmt.Sprintf("%v:%v", r.Server, 995)
+	checked := make(map[string]bool)
+	for {
+		ml, err := r.findMatch(ctx, box, &pred, checked)
+		if err != nil {
+			return err
+		}
 
-	r.log(fmt.Sprintf("Dialing address %v", addr))
-	conn, err := d.Dial("tcp", addr)
-	if err != nil {
-		return mails, err
+		if ml != nil {
+			b, err := json.Marshal(ml.ImapShape())
+			if err != nil {
+				return err
+			}
+			*res = b
+
+			return nil
+		}
+
+		timer := time.NewTimer(opts.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waitErr(ctx)
+		case <-timer.C:
+		}
 	}
-	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+}
 
-	c, err := pop3.NewClient(tlsConn)
+// findMatch opens a session and returns the most recent message matching
+// pred among the ones not checked yet, or nil.
+func (r *Pop3Reader) findMatch(ctx context.Context, box string, pred *MessagePredicate, checked map[string]bool) (*Pop3Mail, error) {
+	c, err := r.connect(ctx)
 	if err != nil {
-		return mails, err
+		return nil, err
 	}
-	defer c.Quit()
 	defer c.Close()
 
-	err = c.Login(r.User, r.Password)
+	uidls, err := c.uidl()
 	if err != nil {
-		return mails, err
+		return nil, err
 	}
-	r.log(fmt.Sprintf("Logged in as %v", r.User))
-
-	messages, err := c.GetMessages()
+	sizes, err := r.listSizes(c)
 	if err != nil {
-		return mails, err
+		return nil, err
 	}
-	r.log(fmt.Sprintf("Message count: %d", len(messages)))
 
-	r.log("Converting messages")
-	for _, msg := range messages {
-		var ml Pop3Mail
+	var (
+		best     *Pop3Mail
+		bestDate time.Time
+	)
+	// newest first: the maildrop is in arrival order, the scan stops at the
+	// first message received before pred.After
+	for n := len(uidls); n >= 1; n-- {
+		uidl, ok := uidls[n]
+		if !ok || checked[uidl] {
+			continue
+		}
 
-		_, m, err := msg.Retrieve()
+		head, err := c.top(n, 0)
 		if err != nil {
-			r.warn(fmt.Sprintf("Warn: error retriving mail %v", err))
+			r.warn(fmt.Sprintf("Warn: error reading headers %v", err))
 			continue
 		}
-
-		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		m, err := mail.ReadMessage(bytes.NewReader(head))
 		if err != nil {
-			r.warn(fmt.Sprintf("Warn: parsing media type error %v", err))
+			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
 			continue
 		}
-
-		if strings.HasPrefix(mediaType, "multipart/") {
-			mr := multipart.NewReader(m.Body, params["boundary"])
-
-			for {
-				p, err := mr.NextPart()
-				if err == io.EOF {
-					break
+		checked[uidl] = true
+
+		date := arrivalDate(m.Header)
+		if !pred.After.IsZero() && date.Before(pred.After) {
+			// the older ones are never looked at again
+			for i := 1; i < n; i++ {
+				if uidl, ok := uidls[i]; ok {
+					checked[uidl] = true
 				}
+			}
+			break
+		}
+		if !pred.matchHeader(m.Header, date) {
+			continue
+		}
 
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: getting part error %v", err))
-					continue
-				}
+		raw, headerOnly, err := r.retrLimited(c, n, sizes)
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: error retriving mail %v", err))
+			delete(checked, uidl)
+			continue
+		}
+		ml, err := r.parseMsg(raw)
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: parsing message error %v", err))
+			continue
+		}
+		if headerOnly {
+			ml.truncate(ErrMessageTooLarge.Error())
+		}
+		ml.Uid = uidl
+		ml.Box = box
 
-				slurp, err := io.ReadAll(p)
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: reading part error %v", err))
-					continue
-				}
+		var bodies []string
+		for _, p := range ml.Parts {
+			bodies = append(bodies, p.Content)
+		}
+		if !pred.matchBody(bodies) {
+			continue
+		}
 
-				var mp Pop3MailPart
-				mp.ContentType = p.Header.Get("Content-Type")
-				mp.Content = string(slurp)
-				ml.ScanMethod = "POP3"
-				ml.ScantAt = time.Now()
+		if best == nil || bestDate.Before(date) {
+			best, bestDate = ml, date
+		}
+	}
 
-				ml.Parts = append(ml.Parts, mp)
+	return best, nil
+}
+
+// arrivalDate guesses when a message arrived from its header.
+func arrivalDate(h mail.Header) time.Time {
+	if received := h["Received"]; len(received) > 0 {
+		// the first Received header is the last hop, the receiving server
+		if i := strings.LastIndex(received[0], ";"); i >= 0 {
+			if t, err := mail.ParseDate(strings.TrimSpace(received[0][i+1:])); err == nil {
+				return t
 			}
 		}
+	}
 
-		ml.Date = m.Header.Get("Date")
-		ml.Subject = m.Header.Get("Subject")
-		ml.From = m.Header.Get("From")
-		ml.Sender = m.Header.Get("Sender")
-		ml.ReplyTo = m.Header.Get("Reply-To")
-		ml.To = m.Header.Get("To")
-		ml.Cc = m.Header.Get("Cc")
-		ml.Bcc = m.Header.Get("Bcc")
-		ml.InReplyTo = m.Header.Get("In-Reply-To")
-		ml.MessageId = m.Header.Get("Message-Id")
-		ml.Email = r.User
-
-		mails = append(mails, ml)
+	if t, err := h.Date(); err == nil {
+		return t
 	}
 
-	return mails, nil
+	return time.Now()
 }
-func (r *Pop3Reader) hotmailBoxGetAll(box string) ([]Pop3Mail, error) {
+
+// boxGetNew retrieves the messages not in seen, or all of them when seen is nil.
+func (r *Pop3Reader) boxGetNew(box string, seen UidlSet) ([]Pop3Mail, UidlSet, error) {
 	r.log(fmt.Sprintf("Start reading box: %v", box))
 
 	var mails []Pop3Mail
 
-	if r.Proxy == nil {
-		return mails, ErrNoProxy
-	}
-
-	d, err := proxy.NewHTTPDialer(r.Proxy)
-	if err != nil {
-		return mails, err
-	}
-	fmt.Printf("start dialing server: %v\n", r.Server)
-
-	addr := fmt.Sprintf("%v:%v", r.Server, 995)
-
-	r.log(fmt.Sprintf("Dialing address %v", addr))
-	conn, err := d.Dial("tcp", addr)
-	if err != nil {
-		return mails, err
+	if !r.hasRoute() {
+		return mails, seen, ErrNoProxy
 	}
-	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
 
-	c, err := pop3.NewClient(tlsConn)
+	c, err := r.connect(context.Background())
 	if err != nil {
-		return mails, err
+		return mails, seen, err
 	}
-	defer c.Quit()
 	defer c.Close()
 
-	err = c.Login(r.User, r.Password)
+	uidls, err := c.uidl()
 	if err != nil {
-		return mails, err
+		return mails, seen, err
 	}
-	r.log(fmt.Sprintf("Logged in as %v", r.User))
-
-	messages, err := c.GetMessages()
+	sizes, err := r.listSizes(c)
 	if err != nil {
-		return mails, err
+		return mails, seen, err
 	}
-	r.log(fmt.Sprintf("Message count: %d", len(messages)))
+	r.log(fmt.Sprintf("Message count: %d", len(uidls)))
+
+	set := make(UidlSet, len(uidls))
+	now := time.Now()
 
 	r.log("Converting messages")
-	for _, msg := range messages {
-		var ml Pop3Mail
+	for n := 1; n <= len(uidls); n++ {
+		uidl, ok := uidls[n]
+		if !ok {
+			continue
+		}
+		if t, ok := seen[uidl]; ok {
+			set[uidl] = t
+			continue
+		}
 
-		_, m, err := msg.Retrieve()
+		raw, headerOnly, err := r.retrLimited(c, n, sizes)
 		if err != nil {
 			r.warn(fmt.Sprintf("Warn: error retriving mail %v", err))
 			continue
 		}
 
-		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		// unparsable messages are marked seen too, or every run would
+		// download them again
+		set[uidl] = now
+
+		ml, err := r.parseMsg(raw)
 		if err != nil {
-			r.warn(fmt.Sprintf("Warn: parsing media type error %v", err))
+			r.warn(fmt.Sprintf("Warn: parsing message %v error %v, skipping it", uidl, err))
 			continue
 		}
+		if headerOnly {
+			ml.truncate(ErrMessageTooLarge.Error())
+		}
+		ml.Uid = uidl
+		ml.Box = box
 
-		if strings.HasPrefix(mediaType, "multipart/") {
-			mr := multipart.NewReader(m.Body, params["boundary"])
+		mails = append(mails, *ml)
+	}
 
-			for {
-				p, err := mr.NextPart()
-				if err == io.EOF {
-					break
-				}
+	return mails, set, nil
+}
 
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: getting part error %v", err))
-					continue
-				}
+// connect dials the configured server through the proxy and logs in.
+func (r *Pop3Reader) connect(ctx context.Context) (*pop3Session, error) {
+	tlsConfig, err := r.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		r.warn("Warn: TLS certificate verification is disabled")
+	}
 
-				slurp, err := io.ReadAll(p)
-				if err != nil {
-					r.warn(fmt.Sprintf("Warn: reading part error %v", err))
-					continue
-				}
+	addr := r.addr(995, 110)
+
+	r.log(fmt.Sprintf("Dialing address %v", addr))
+	conn, err := r.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.implicitTLS() {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
 
-				var mp Pop3MailPart
-				mp.ContentType = p.Header.Get("Content-Type")
-				mp.Content = string(slurp)
-				ml.ScanMethod = "POP3"
-				ml.ScantAt = time.Now()
+	c, err := newPop3Session(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-				ml.Parts = append(ml.Parts, mp)
-			}
+	if err := c.capa(); err != nil {
+		c.abort()
+		return nil, err
+	}
+
+	if r.Security == SecurityStartTLS {
+		if err := c.startTLS(tlsConfig); err != nil {
+			c.abort()
+			return nil, err
+		}
+	}
+
+	err = c.login(ctx, &r.ReaderConfig)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	r.log(fmt.Sprintf("Logged in as %v", r.User))
+
+	return c, nil
+}
+
+func (r *Pop3Reader) parseMsg(raw []byte) (*Pop3Mail, error) {
+	var ml Pop3Mail
+
+	limits := r.limits()
+	m, err := readMessage(bytes.NewReader(raw), limits.MaxHeaderSize)
+	if errors.Is(err, ErrHeaderTooLarge) {
+		ml.truncate(err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	tree, err := ParseMimeTreeLimits(m, limits)
+	if err != nil {
+		r.warn(fmt.Sprintf("Warn: parsing parts error %v", err))
+	}
+	ml.truncate(tree.TruncatedReason)
+
+	for _, p := range tree.Leaves() {
+		if p.IsAttachment() {
+			continue
 		}
+		ml.Parts = append(ml.Parts, Pop3MailPart{
+			Path:        p.Path,
+			ContentType: partContentType(p),
+			Charset:     p.Charset,
+			Content:     p.Content,
+		})
+	}
 
-		ml.Date = m.Header.Get("Date")
-		ml.Subject = m.Header.Get("Subject")
-		ml.From = m.Header.Get("From")
-		ml.Sender = m.Header.Get("Sender")
-		ml.ReplyTo = m.Header.Get("Reply-To")
-		ml.To = m.Header.Get("To")
-		ml.Cc = m.Header.Get("Cc")
-		ml.Bcc = m.Header.Get("Bcc")
-		ml.InReplyTo = m.Header.Get("In-Reply-To")
-		ml.MessageId = m.Header.Get("Message-Id")
-		ml.Email = r.User
+	ml.Attachments = tree.Attachments()
+
+	charset := tree.textCharset()
+	ml.Date = m.Header.Get("Date")
+	ml.Subject = decodeHeader(m.Header.Get("Subject"), charset)
+	ml.From = decodeHeader(m.Header.Get("From"), charset)
+	ml.Sender = decodeHeader(m.Header.Get("Sender"), charset)
+	ml.ReplyTo = decodeHeader(m.Header.Get("Reply-To"), charset)
+	ml.To = decodeHeader(m.Header.Get("To"), charset)
+	ml.Cc = decodeHeader(m.Header.Get("Cc"), charset)
+	ml.Bcc = decodeHeader(m.Header.Get("Bcc"), charset)
+	ml.InReplyTo = m.Header.Get("In-Reply-To")
+	ml.MessageId = m.Header.Get("Message-Id")
+	ml.ScanMethod = "POP3"
+	ml.ScantAt = time.Now()
+	ml.Email = r.User
+
+	return &ml, nil
+}
+
+// listSizes returns the sizes of the messages of the session, nil when
+// MaxMessageSize is lifted.
+func (r *Pop3Reader) listSizes(c *pop3Session) (map[int]int64, error) {
+	if r.limits().MaxMessageSize <= 0 {
+		return nil, nil
+	}
+	return c.list()
+}
+
+// retrLimited retrieves message n, only its header when sizes tells it is
+// over MaxMessageSize.
+func (r *Pop3Reader) retrLimited(c *pop3Session, n int, sizes map[int]int64) ([]byte, bool, error) {
+	if r.limits().tooLarge(sizes[n]) {
+		head, err := c.top(n, 0)
+		return head, true, err
+	}
+	raw, err := c.retr(n)
+	return raw, false, err
+}
+
+// Pop3ImapMail is a POP3 message in the shape of ImapMail, the UIDL kept
+// aside since IMAP uids are numbers.
+type Pop3ImapMail struct {
+	ImapMail
+	// The UIDL of the message, Uid is zero.
+	Uidl string `json:"uidl"`
+}
 
-		mails = append(mails, ml)
+// ImapShape converts m to the result shape of the IMAP reader: addresses
+// become lists of bare addresses, their names going to Names, and the date
+// a time, zero when the Date header cannot be parsed.
+func (m *Pop3Mail) ImapShape() *Pop3ImapMail {
+	ml := &Pop3ImapMail{
+		Uidl: m.Uid,
+		ImapMail: ImapMail{
+			Subject:         m.Subject,
+			InReplyTo:       m.InReplyTo,
+			MessageId:       m.MessageId,
+			Attachments:     m.Attachments,
+			Truncated:       m.Truncated,
+			TruncatedReason: m.TruncatedReason,
+			Box:             m.Box,
+			ScantAt:         m.ScantAt,
+			ScanMethod:      m.ScanMethod,
+			Email:           m.Email,
+		},
 	}
+	ml.From = ml.headerAddresses(m.From)
+	ml.Sender = ml.headerAddresses(m.Sender)
+	ml.ReplyTo = ml.headerAddresses(m.ReplyTo)
+	ml.To = ml.headerAddresses(m.To)
+	ml.Cc = ml.headerAddresses(m.Cc)
+	ml.Bcc = ml.headerAddresses(m.Bcc)
+	if t, err := mail.ParseDate(m.Date); err == nil {
+		ml.Date = t.Local()
+	}
+	for _, p := range m.Parts {
+		ml.Parts = append(ml.Parts, ImapMailPart(p))
+	}
+	return ml
+}
 
-	return mails, nil
+// headerAddresses returns the bare addresses of the decoded header field v,
+// keeping their display names in m.Names.
+func (m *ImapMail) headerAddresses(v string) []string {
+	list, err := addressParser.ParseList(v)
+	if err != nil {
+		return bareAddresses(v)
+	}
+
+	var addrs []string
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+		if a.Name != "" {
+			if m.Names == nil {
+				m.Names = make(map[string]string)
+			}
+			m.Names[a.Address] = a.Name
+		}
+	}
+	return addrs
 }
 
 func (r *Pop3Reader) log(l string) {
@@ -0,0 +1,144 @@
+package mailreader
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type RetentionMode string
+
+var (
+	// RetainForever leaves every message on the server.
+	RetainForever RetentionMode = "forever"
+	// DeleteAfterRetrieve deletes a message once it has been processed.
+	DeleteAfterRetrieve RetentionMode = "delete"
+	// RetainDays deletes a message a number of days after it was processed.
+	RetainDays RetentionMode = "days"
+)
+
+// RetentionPolicy tells BoxProcess what to do with processed messages.
+type RetentionPolicy struct {
+	Mode RetentionMode
+	// Days is used by RetainDays.
+	Days int
+}
+
+// expired reports whether a message processed at seenAt must be deleted.
+func (p RetentionPolicy) expired(seenAt time.Time) bool {
+	switch p.Mode {
+	case DeleteAfterRetrieve:
+		return true
+	case RetainDays:
+		return time.Since(seenAt) >= time.Duration(p.Days)*24*time.Hour
+	}
+
+	return false
+}
+
+// BoxProcess hands every message whose UIDL is not in seen to handle and
+// applies policy. A message is only deleted once handle returned nil for it.
+// If handle fails the deletions of the session are rolled back with RSET,
+// the messages processed so far are kept in the returned set so they are
+// not handed out again. Messages that cannot be retrieved or parsed are
+// skipped with a warning and marked seen, the policy applies to them from the
+// next run on.
+func (r *Pop3Reader) BoxProcess(mailbox MailBox, seen UidlSet, policy RetentionPolicy, handle func(m *Pop3Mail) error) (UidlSet, error) {
+	box := fmt.Sprintf("%v", mailbox)
+	r.log(fmt.Sprintf("Start processing box: %v", box))
+
+	if seen == nil {
+		seen = make(UidlSet)
+	}
+
+	if !r.hasRoute() {
+		return seen, ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return seen, err
+	}
+
+	uidls, err := c.uidl()
+	if err != nil {
+		c.Close()
+		return seen, err
+	}
+	sizes, err := r.listSizes(c)
+	if err != nil {
+		c.Close()
+		return seen, err
+	}
+	r.log(fmt.Sprintf("Message count: %d", len(uidls)))
+
+	// keep what is still on the server, even when returning early
+	set := make(UidlSet, len(uidls))
+	for _, uidl := range uidls {
+		if t, ok := seen[uidl]; ok {
+			set[uidl] = t
+		}
+	}
+
+	for n := 1; n <= len(uidls); n++ {
+		uidl, ok := uidls[n]
+		if !ok {
+			continue
+		}
+
+		seenAt, ok := seen[uidl]
+		if !ok {
+			// marked seen, or every run would download them again
+			raw, headerOnly, err := r.retrLimited(c, n, sizes)
+			if err != nil {
+				r.warn(fmt.Sprintf("Warn: error retriving mail %v %v, skipping it", uidl, err))
+				set[uidl] = time.Now()
+				continue
+			}
+
+			ml, err := r.parseMsg(raw)
+			if err != nil {
+				r.warn(fmt.Sprintf("Warn: parsing message %v error %v, skipping it", uidl, err))
+				set[uidl] = time.Now()
+				continue
+			}
+			if headerOnly {
+				ml.truncate(ErrMessageTooLarge.Error())
+			}
+			ml.Uid = uidl
+			ml.Box = box
+
+			if err := handle(ml); err != nil {
+				r.rollback(c)
+				return set, fmt.Errorf("processing message %v: %w", uidl, err)
+			}
+			seenAt = time.Now()
+		}
+		set[uidl] = seenAt
+
+		if policy.expired(seenAt) {
+			if _, err := c.cmd("DELE", n); err != nil {
+				r.rollback(c)
+				return set, err
+			}
+		}
+	}
+
+	// deletions only happen once QUIT succeeds
+	if err := c.Close(); err != nil {
+		return set, err
+	}
+
+	return set, nil
+}
+
+// rollback undoes the deletions of the session and closes it. The connection
+// is dropped without QUIT if RSET fails, which discards them as well.
+func (r *Pop3Reader) rollback(c *pop3Session) {
+	if _, err := c.cmd("RSET"); err != nil {
+		r.warn(fmt.Sprintf("Warn: RSET error %v", err))
+		c.abort()
+		return
+	}
+	c.Close()
+}
@@ -0,0 +1,247 @@
+package mailreader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// BoxScanHeaders lists the messages of the mailbox with TOP, without
+// downloading their bodies. When previewLines is positive the first body
+// lines of every message are included as a preview.
+func (r *Pop3Reader) BoxScanHeaders(mailbox MailBox, previewLines int, res *[]byte) error {
+	r.log(fmt.Sprintf("Start scanning box: %v", mailbox))
+
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	sizes, err := c.list()
+	if err != nil {
+		return err
+	}
+	uidls, err := c.uidlOptional()
+	if err != nil {
+		return err
+	}
+	r.log(fmt.Sprintf("Message count: %d", len(sizes)))
+
+	if previewLines < 0 {
+		previewLines = 0
+	}
+
+	var summaries []Pop3MailSummary
+	for n := 1; n <= len(sizes); n++ {
+		size, ok := sizes[n]
+		if !ok {
+			continue
+		}
+
+		raw, err := c.top(n, previewLines)
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: error reading headers %v", err))
+			continue
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
+			continue
+		}
+
+		charset := contentCharset(m.Header)
+		s := Pop3MailSummary{
+			Number:    n,
+			Uid:       uidls[n],
+			Size:      size,
+			Date:      m.Header.Get("Date"),
+			Subject:   decodeHeader(m.Header.Get("Subject"), charset),
+			From:      decodeHeader(m.Header.Get("From"), charset),
+			To:        decodeHeader(m.Header.Get("To"), charset),
+			Cc:        decodeHeader(m.Header.Get("Cc"), charset),
+			MessageId: m.Header.Get("Message-Id"),
+		}
+		if previewLines > 0 {
+			preview, _ := io.ReadAll(m.Body)
+			s.Preview = strings.TrimRight(string(preview), "\r\n")
+		}
+
+		summaries = append(summaries, s)
+	}
+
+	b, err := json.Marshal(summaries)
+	if err != nil {
+		return err
+	}
+	*res = b
+
+	return nil
+}
+
+// RetrieveByNumber retrieves message n of mailbox. Message numbers are only
+// stable within a session, prefer RetrieveByUidl across connections. It
+// also works with the servers without UIDL.
+func (r *Pop3Reader) RetrieveByNumber(mailbox MailBox, n int, res *[]byte) error {
+	return r.retrieve(mailbox, res, func(uidls map[int]string) (int, bool) {
+		_, ok := uidls[n]
+		return n, ok
+	})
+}
+
+// RetrieveByUidl retrieves the message of mailbox with the given UIDL.
+func (r *Pop3Reader) RetrieveByUidl(mailbox MailBox, uidl string, res *[]byte) error {
+	return r.retrieve(mailbox, res, func(uidls map[int]string) (int, bool) {
+		for n, u := range uidls {
+			if u != "" && u == uidl {
+				return n, true
+			}
+		}
+		return 0, false
+	})
+}
+
+// retrieve stores as JSON into res the message of mailbox picked by find.
+func (r *Pop3Reader) retrieve(mailbox MailBox, res *[]byte, find func(uidls map[int]string) (int, bool)) error {
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	uidls, err := c.uidlOptional()
+	if err != nil {
+		return err
+	}
+
+	n, ok := find(uidls)
+	if !ok {
+		return ErrMessageNotFound
+	}
+
+	sizes, err := r.listSizes(c)
+	if err != nil {
+		return err
+	}
+	raw, headerOnly, err := r.retrLimited(c, n, sizes)
+	if err != nil {
+		return err
+	}
+
+	ml, err := r.parseMsg(raw)
+	if err != nil {
+		return err
+	}
+	if headerOnly {
+		ml.truncate(ErrMessageTooLarge.Error())
+	}
+	ml.Uid = uidls[n]
+	ml.Box = fmt.Sprintf("%v", mailbox)
+
+	b, err := json.Marshal(ml)
+	if err != nil {
+		return err
+	}
+	*res = b
+
+	return nil
+}
+
+// StreamAttachments streams the attachments of the message with the given
+// UIDL to sink while it is retrieved, see the StreamAttachments function.
+func (r *Pop3Reader) StreamAttachments(uidl string, filter *AttachmentFilter, sink AttachmentSink) ([]Attachment, error) {
+	var atts []Attachment
+	err := r.retrieveRaw(uidl, false, func(msg io.Reader) error {
+		var err error
+		atts, err = streamAttachments(msg, filter, sink, r.limits())
+		return err
+	})
+	return atts, err
+}
+
+// RenderHTML renders the message with the given UIDL as a self-contained
+// HTML document, see MimePart.RenderHTML. A message over MaxMessageSize is
+// not retrieved, ErrMessageTooLarge is returned.
+func (r *Pop3Reader) RenderHTML(uidl string, opts RenderOptions) (string, error) {
+	var doc string
+	err := r.retrieveRaw(uidl, true, func(msg io.Reader) error {
+		var err error
+		doc, err = renderMessage(msg, opts, r.limits())
+		return err
+	})
+	return doc, err
+}
+
+// retrieveRaw hands the message with the given UIDL to read while it is
+// retrieved. With limited set, a message over MaxMessageSize is not.
+func (r *Pop3Reader) retrieveRaw(uidl string, limited bool, read func(msg io.Reader) error) error {
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
+
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return err
+	}
+
+	uidls, err := c.uidl()
+	if err != nil {
+		c.abort()
+		return err
+	}
+
+	n := 0
+	for i, u := range uidls {
+		if u == uidl {
+			n = i
+		}
+	}
+	if n == 0 {
+		c.Close()
+		return ErrMessageNotFound
+	}
+
+	if limited {
+		sizes, err := r.listSizes(c)
+		if err != nil {
+			c.abort()
+			return err
+		}
+		if r.limits().tooLarge(sizes[n]) {
+			c.Close()
+			return ErrMessageTooLarge
+		}
+	}
+
+	body, err := c.retrReader(n)
+	if err != nil {
+		c.abort()
+		return err
+	}
+
+	err = read(body)
+	if err == nil {
+		// what read left, after the last part
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err != nil {
+		// the response was not read to its end
+		c.abort()
+		return err
+	}
+
+	return c.Close()
+}
@@ -0,0 +1,236 @@
+package mailreader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/denisss025/go-pop3-client"
+)
+
+// pop3Session is a logged in POP3 connection. The pop3 client only exposes
+// LIST, RETR and DELE, the methods below speak the rest of the protocol over
+// its textproto reader and writer.
+type pop3Session struct {
+	*pop3.Client
+	conn     net.Conn
+	greeting string
+	caps     map[string][]string
+}
+
+// newPop3Session reads the greeting, kept for APOP, and starts the client.
+func newPop3Session(conn net.Conn) (*pop3Session, error) {
+	// read byte by byte so nothing past the greeting is consumed
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err := conn.Read(b); err != nil {
+			return nil, fmt.Errorf("greeting: %v", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+
+	greeting := strings.TrimRight(string(line), "\r")
+	if _, err := pop3Status("greeting", greeting); err != nil {
+		return nil, err
+	}
+
+	s := &pop3Session{greeting: greeting}
+	if err := s.reset(conn, greeting); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// reset starts a new client on conn, handing it greeting as the first line.
+func (s *pop3Session) reset(conn net.Conn, greeting string) error {
+	c, err := pop3.NewClient(&replayConn{
+		Conn: conn,
+		r:    io.MultiReader(strings.NewReader(greeting+"\r\n"), conn),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Client = c
+	s.conn = conn
+	return nil
+}
+
+// replayConn reads from r instead of the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// pop3Err is a -ERR response of the server.
+type pop3Err string
+
+func (e pop3Err) Error() string {
+	return string(e)
+}
+
+// abort drops the connection without QUIT, so the server discards the
+// deletions of the session.
+func (s *pop3Session) abort() error {
+	return s.conn.Close()
+}
+
+// cmd sends a single line command and returns the text following +OK.
+func (s *pop3Session) cmd(cmd string, args ...interface{}) (string, error) {
+	line := cmd
+	for _, a := range args {
+		line += fmt.Sprintf(" %v", a)
+	}
+
+	if err := s.Writer.PrintfLine("%s", line); err != nil {
+		return "", fmt.Errorf("%s: %v", cmd, err)
+	}
+
+	resp, err := s.Reader.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", cmd, err)
+	}
+
+	return pop3Status(cmd, resp)
+}
+
+// pop3Status parses a status line.
+func pop3Status(cmd, resp string) (string, error) {
+	switch {
+	case resp == "+OK":
+		return "", nil
+	case strings.HasPrefix(resp, "+OK "):
+		return resp[4:], nil
+	case strings.HasPrefix(resp, "-ERR"):
+		return "", pop3Err(fmt.Sprintf("%s: %s", cmd, strings.TrimSpace(resp[4:])))
+	}
+
+	return "", fmt.Errorf("%s: unexpected response: %s", cmd, resp)
+}
+
+// lines sends a command answered by a dot terminated list of lines.
+func (s *pop3Session) lines(cmd string, args ...interface{}) ([]string, error) {
+	if _, err := s.cmd(cmd, args...); err != nil {
+		return nil, err
+	}
+
+	lines, err := s.Reader.ReadDotLines()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cmd, err)
+	}
+
+	return lines, nil
+}
+
+// uidl maps the message numbers of the session to their UIDL.
+func (s *pop3Session) uidl() (map[int]string, error) {
+	lines, err := s.lines("UIDL")
+	if err != nil {
+		return nil, err
+	}
+
+	uidls := make(map[int]string, len(lines))
+	for _, l := range lines {
+		var (
+			n    int
+			uidl string
+		)
+		if _, err := fmt.Sscanf(l, "%d %s", &n, &uidl); err != nil {
+			return nil, fmt.Errorf("UIDL: parse %q: %v", l, err)
+		}
+		uidls[n] = uidl
+	}
+
+	return uidls, nil
+}
+
+// uidlOptional is uidl for the servers without UIDL, optional in RFC 1939:
+// the messages of LIST are then mapped to an empty UIDL.
+func (s *pop3Session) uidlOptional() (map[int]string, error) {
+	uidls, err := s.uidl()
+	var perr pop3Err
+	if !errors.As(err, &perr) {
+		return uidls, err
+	}
+
+	sizes, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	uidls = make(map[int]string, len(sizes))
+	for n := range sizes {
+		uidls[n] = ""
+	}
+	return uidls, nil
+}
+
+// retr retrieves the raw message n.
+func (s *pop3Session) retr(n int) ([]byte, error) {
+	body, err := s.retrReader(n)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("RETR: %v", err)
+	}
+
+	return raw, nil
+}
+
+// retrReader starts retrieving message n, read from the returned reader.
+// The whole message has to be read before the next command.
+func (s *pop3Session) retrReader(n int) (io.Reader, error) {
+	if _, err := s.cmd("RETR", n); err != nil {
+		return nil, err
+	}
+	return s.Reader.DotReader(), nil
+}
+
+// list maps the message numbers of the session to their size.
+func (s *pop3Session) list() (map[int]int64, error) {
+	lines, err := s.lines("LIST")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[int]int64, len(lines))
+	for _, l := range lines {
+		var (
+			n    int
+			size int64
+		)
+		if _, err := fmt.Sscanf(l, "%d %d", &n, &size); err != nil {
+			return nil, fmt.Errorf("LIST: parse %q: %v", l, err)
+		}
+		sizes[n] = size
+	}
+
+	return sizes, nil
+}
+
+// top retrieves the header and the first lines of the body of message n.
+func (s *pop3Session) top(n, lines int) ([]byte, error) {
+	if _, err := s.cmd("TOP", n, lines); err != nil {
+		return nil, err
+	}
+
+	raw, err := io.ReadAll(s.Reader.DotReader())
+	if err != nil {
+		return nil, fmt.Errorf("TOP: %v", err)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stage is a step of a proxy diagnosis.
+type Stage string
+
+var (
+	// StageProxy is reaching the first proxy over TCP.
+	StageProxy Stage = "proxy"
+	// StageConnect is the CONNECT or SOCKS5 handshake opening the tunnel.
+	StageConnect Stage = "connect"
+	// StageTLS is the TLS handshake with the target.
+	StageTLS Stage = "tls"
+	// StageGreeting is reading the IMAP or POP3 greeting of the target.
+	StageGreeting Stage = "greeting"
+	// StageExitIP is looking up the address the proxy exits from.
+	StageExitIP Stage = "exit-ip"
+)
+
+type DiagnoseOptions struct {
+	// Target is the host:port of the mail server, such as "imap.gmail.com:993".
+	Target string
+	// PlainText skips the TLS handshake, for targets without implicit TLS.
+	PlainText bool
+	// TLSConfig is used for the TLS handshake with the target. The
+	// certificate is verified for the target host when nil.
+	TLSConfig *tls.Config
+	// Timeout bounds the whole diagnosis, 30 seconds by default.
+	Timeout time.Duration
+	// ExitIPURL, when set, is fetched through the proxy and its body
+	// reported as the exit IP, such as "https://api.ipify.org".
+	ExitIPURL string
+}
+
+// Report tells how far a diagnosis went and how long each stage took.
+type Report struct {
+	Proxy  string
+	Target string
+	// FailedStage is empty when every stage succeeded.
+	FailedStage Stage
+	Err         error
+
+	ProxyLatency    time.Duration
+	ConnectLatency  time.Duration
+	TLSLatency      time.Duration
+	GreetingLatency time.Duration
+
+	Greeting string
+	ExitIP   string
+}
+
+func (r *Report) OK() bool {
+	return r.FailedStage == ""
+}
+
+func (r *Report) fail(stage Stage, err error) *Report {
+	r.FailedStage = stage
+	r.Err = err
+	return r
+}
+
+// Diagnose opens a tunnel to the target through the proxy described by cfg,
+// then does the TLS handshake and reads the server greeting, timing every
+// stage and reporting the first one failing.
+func Diagnose(ctx context.Context, cfg *Config, opts DiagnoseOptions) *Report {
+	r := &Report{Target: opts.Target}
+	if cfg != nil {
+		r.Proxy = cfg.String()
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	first := &timingDialer{forward: Direct}
+	d, err := NewDialerVia(cfg, first)
+	if err != nil {
+		return r.fail(StageProxy, err)
+	}
+
+	start := time.Now()
+	conn, err := dialContext(ctx, d, "tcp", opts.Target)
+	elapsed := time.Since(start)
+
+	reached, proxyErr := first.result()
+	if !reached {
+		// gave up before the proxy answered
+		return r.fail(StageProxy, err)
+	}
+	if proxyErr != nil {
+		return r.fail(StageProxy, proxyErr)
+	}
+	r.ProxyLatency = first.elapsed
+	r.ConnectLatency = elapsed - first.elapsed
+	if err != nil {
+		return r.fail(StageConnect, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if !opts.PlainText {
+		tlsConfig := opts.TLSConfig
+		if tlsConfig == nil {
+			host, _, _ := net.SplitHostPort(opts.Target)
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+
+		start = time.Now()
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		r.TLSLatency = time.Since(start)
+		if err != nil {
+			return r.fail(StageTLS, err)
+		}
+		conn = tlsConn
+	}
+
+	start = time.Now()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	r.GreetingLatency = time.Since(start)
+	r.Greeting = strings.TrimSpace(line)
+	if err != nil {
+		return r.fail(StageGreeting, err)
+	}
+	if !strings.HasPrefix(r.Greeting, "* OK") && !strings.HasPrefix(r.Greeting, "* PREAUTH") && !strings.HasPrefix(r.Greeting, "+OK") {
+		return r.fail(StageGreeting, fmt.Errorf("server refused the connection: %s", r.Greeting))
+	}
+
+	if opts.ExitIPURL != "" {
+		ip, err := exitIP(ctx, cfg, opts.ExitIPURL)
+		if err != nil {
+			return r.fail(StageExitIP, err)
+		}
+		r.ExitIP = ip
+	}
+
+	return r
+}
+
+// exitIP fetches url through the proxy and returns the body.
+func exitIP(ctx context.Context, cfg *Config, url string) (string, error) {
+	d, err := NewDialer(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialContext(ctx, d, network, addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("exit IP lookup: %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+
+	ip := strings.TrimSpace(string(b))
+	if net.ParseIP(ip) == nil {
+		return "", errors.New("exit IP lookup: unexpected response")
+	}
+
+	return ip, nil
+}
+
+// timingDialer records how long its first dial took.
+type timingDialer struct {
+	forward Dialer
+
+	mu      sync.Mutex
+	done    bool
+	elapsed time.Duration
+	err     error
+}
+
+func (d *timingDialer) Dial(network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.forward.Dial(network, addr)
+
+	d.mu.Lock()
+	if !d.done {
+		d.done, d.elapsed, d.err = true, time.Since(start), err
+	}
+	d.mu.Unlock()
+
+	return conn, err
+}
+
+// result reports whether the first dial returned and its error.
+func (d *timingDialer) result() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.done, d.err
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestChallenge is a Digest challenge of a Proxy-Authenticate header, as
+// described by RFC 7616.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// parseDigestChallenge picks the first Digest challenge of the headers.
+func parseDigestChallenge(headers []string) (*digestChallenge, bool) {
+	for _, h := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(h), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		ch := &digestChallenge{}
+		for k, v := range parseAuthParams(params) {
+			switch k {
+			case "realm":
+				ch.realm = v
+			case "nonce":
+				ch.nonce = v
+			case "opaque":
+				ch.opaque = v
+			case "algorithm":
+				ch.algorithm = v
+			case "qop":
+				// prefer auth, auth-int needs the body
+				for _, q := range strings.Split(v, ",") {
+					if strings.TrimSpace(q) == "auth" {
+						ch.qop = "auth"
+					}
+				}
+			}
+		}
+		if ch.nonce != "" {
+			return ch, true
+		}
+	}
+
+	return nil, false
+}
+
+// parseAuthParams splits comma separated key=value pairs, values being
+// optionally quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			val = b.String()
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+			val = strings.TrimSpace(val)
+			rest = "," + rest
+		}
+		params[key] = val
+
+		_, s, _ = strings.Cut(rest, ",")
+	}
+
+	return params
+}
+
+// authorization returns the Proxy-Authorization header answering the challenge.
+func (ch *digestChallenge) authorization(username, password, method, uri string) string {
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(ch.algorithm)
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := h(username + ":" + ch.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if ch.qop != "" {
+		response = h(strings.Join([]string{ha1, ch.nonce, nc, cnonce, ch.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + ch.nonce + ":" + ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, ch.realm, ch.nonce, uri, response)
+	if ch.algorithm != "" {
+		auth += ", algorithm=" + ch.algorithm
+	}
+	if ch.opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, ch.opaque)
+	}
+	if ch.qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, ch.qop, nc, cnonce)
+	}
+
+	return auth
+}
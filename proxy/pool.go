@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoHealthyProxy = errors.New("no healthy proxy")
+)
+
+type Policy string
+
+var (
+	PolicyRoundRobin Policy = "round-robin"
+	PolicyRandom     Policy = "random"
+	// PolicyLeastUsed picks the proxy with the fewest open connections.
+	PolicyLeastUsed Policy = "least-used"
+	// PolicySticky keeps using the same proxy for an account while it is
+	// healthy, see Pool.ForAccount. Other dials are round-robin.
+	PolicySticky Policy = "sticky"
+)
+
+type PoolOptions struct {
+	// Policy defaults to PolicyRoundRobin.
+	Policy Policy
+	// HealthTarget is the host:port health checks CONNECT to, such as
+	// "imap.gmail.com:993". Health checks are off when empty.
+	HealthTarget string
+	// HealthInterval is the delay between two health checks, one minute
+	// by default.
+	HealthInterval time.Duration
+	// HealthTimeout bounds a single check, ten seconds by default.
+	HealthTimeout time.Duration
+	// Cooldown is how long a proxy that cannot be reached or fails its
+	// handshake is left out, five minutes by default. Configuration and
+	// secret source errors leave it in.
+	Cooldown time.Duration
+	// Retries is how many other proxies a dial tries after a failure.
+	Retries int
+	// Forward dials the proxies, Direct when nil.
+	Forward Dialer
+}
+
+// Pool spreads connections over several proxies, leaving out the ones
+// failing for a cooldown period. It implements Dialer.
+type Pool struct {
+	opts PoolOptions
+
+	mu      sync.Mutex
+	members []*member
+	next    int
+	sticky  map[string]*member
+}
+
+// member is a proxy of the pool and its usage.
+type member struct {
+	cfg          *Config
+	active       int
+	uses         uint64
+	evictedUntil time.Time
+}
+
+func NewPool(configs []*Config, opts PoolOptions) *Pool {
+	if opts.Policy == "" {
+		opts.Policy = PolicyRoundRobin
+	}
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = time.Minute
+	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = 10 * time.Second
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 5 * time.Minute
+	}
+	if opts.Forward == nil {
+		opts.Forward = Direct
+	}
+
+	p := &Pool{
+		opts:   opts,
+		sticky: make(map[string]*member),
+	}
+	for _, c := range configs {
+		p.members = append(p.members, &member{cfg: c})
+	}
+
+	return p
+}
+
+// Dial connects to addr through a proxy picked by the pool policy.
+func (p *Pool) Dial(network, addr string) (net.Conn, error) {
+	return p.dial("", network, addr)
+}
+
+// ForAccount returns a dialer of the pool bound to account. With
+// PolicySticky all its dials go through the same proxy until it fails.
+func (p *Pool) ForAccount(account string) Dialer {
+	return &accountDialer{pool: p, account: account}
+}
+
+type accountDialer struct {
+	pool    *Pool
+	account string
+}
+
+func (d *accountDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.pool.dial(d.account, network, addr)
+}
+
+// dial tries up to Retries other proxies when the picked one fails.
+func (p *Pool) dial(account, network, addr string) (net.Conn, error) {
+	tried := make(map[*member]bool)
+
+	var lastErr error
+	for i := 0; i <= p.opts.Retries; i++ {
+		m := p.pick(account, tried)
+		if m == nil {
+			break
+		}
+		tried[m] = true
+
+		conn, err := p.dialVia(m, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		var derr *dialerError
+		if errors.As(err, &derr) {
+			// this proxy is misconfigured, the others may not be, and
+			// evicting it would not fix it
+			lastErr = err
+			continue
+		}
+		if !proxyFault(err) {
+			// another proxy would fail the same
+			return nil, err
+		}
+		lastErr = err
+		p.evict(m)
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNoHealthyProxy
+}
+
+func (p *Pool) dialVia(m *member, network, addr string) (net.Conn, error) {
+	d, err := NewDialerVia(m.cfg, p.opts.Forward)
+	if err != nil {
+		p.release(m)
+		return nil, &dialerError{err}
+	}
+
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		p.release(m)
+		return nil, err
+	}
+
+	return &poolConn{Conn: conn, release: func() { p.release(m) }}, nil
+}
+
+// pick returns a healthy member not in tried and accounts for its use.
+func (p *Pool) pick(account string, tried map[*member]bool) *member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var healthy []*member
+	for _, m := range p.members {
+		if !tried[m] && !now.Before(m.evictedUntil) {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	var m *member
+	switch p.opts.Policy {
+	case PolicyRandom:
+		m = healthy[rand.Intn(len(healthy))]
+	case PolicyLeastUsed:
+		for _, h := range healthy {
+			if m == nil || h.active < m.active || h.active == m.active && h.uses < m.uses {
+				m = h
+			}
+		}
+	case PolicySticky:
+		if s := p.sticky[account]; account != "" && s != nil && !tried[s] && !now.Before(s.evictedUntil) {
+			m = s
+		}
+	}
+	if m == nil {
+		m = healthy[p.next%len(healthy)]
+		p.next++
+	}
+
+	if p.opts.Policy == PolicySticky && account != "" {
+		p.sticky[account] = m
+	}
+	m.active++
+	m.uses++
+
+	return m
+}
+
+func (p *Pool) release(m *member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.active--
+}
+
+func (p *Pool) evict(m *member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.evictedUntil = time.Now().Add(p.opts.Cooldown)
+}
+
+// Run checks the health of every proxy each HealthInterval until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	if p.opts.HealthTarget == "" {
+		return
+	}
+
+	ticker := time.NewTicker(p.opts.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		p.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check CONNECTs to HealthTarget through every proxy, evicting the ones
+// failing and bringing back the evicted ones that work again. A failure of
+// HealthTarget itself evicts nothing. Check does nothing without
+// HealthTarget.
+func (p *Pool) Check(ctx context.Context) {
+	if p.opts.HealthTarget == "" {
+		return
+	}
+
+	p.mu.Lock()
+	members := append([]*member(nil), p.members...)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+
+			if err := p.check(ctx, m); err != nil {
+				if proxyFault(err) && ctx.Err() == nil {
+					p.evict(m)
+				}
+				return
+			}
+
+			p.mu.Lock()
+			m.evictedUntil = time.Time{}
+			p.mu.Unlock()
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) check(ctx context.Context, m *member) error {
+	d, err := NewDialerVia(m.cfg, p.opts.Forward)
+	if err != nil {
+		return &dialerError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.opts.HealthTimeout)
+	defer cancel()
+
+	conn, err := dialContext(ctx, d, "tcp", p.opts.HealthTarget)
+	if err != nil {
+		return fmt.Errorf("health check of %v: %w", m.cfg, err)
+	}
+	return conn.Close()
+}
+
+// socksTargetReplies are the SOCKS5 replies telling the target failed.
+var socksTargetReplies = []string{"network unreachable", "host unreachable", "connection refused", "TTL expired"}
+
+// dialerError is a failure to build the dialer of a proxy, from its
+// configuration or its secret source, before the proxy is ever reached.
+type dialerError struct {
+	err error
+}
+
+func (e *dialerError) Error() string { return e.err.Error() }
+func (e *dialerError) Unwrap() error { return e.err }
+
+// proxyFault reports whether err, returned by a dial through a proxy, is
+// the fault of the proxy: it could not be reached, its handshake failed or
+// it refused the tunnel. Failures of the target are not, nor are errors
+// building the dialer, which no cooldown fixes.
+func proxyFault(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) || errors.Is(err, context.Canceled) {
+		// the target resolved locally, or the caller gave up
+		return false
+	}
+
+	var derr *dialerError
+	if errors.As(err, &derr) {
+		return false
+	}
+
+	var ce *ConnectError
+	if errors.As(err, &ce) {
+		// the proxy could not reach the target
+		return ce.StatusCode != http.StatusBadGateway && ce.StatusCode != http.StatusGatewayTimeout
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && strings.HasPrefix(oe.Op, "socks") && oe.Err != nil {
+		for _, reply := range socksTargetReplies {
+			// as x/net reports the reply, dial errors of the proxy differ
+			if oe.Err.Error() == "unknown error "+reply {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// poolConn gives its proxy back to the pool once closed.
+type poolConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -2,25 +2,77 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
+
+	"github.com/New-Moon-Team/gomailreader/secret"
 
 	"golang.org/x/net/proxy"
 )
 
 var (
-	ErrInvalidProxy = errors.New("invalid proxy")
+	ErrInvalidProxy      = errors.New("invalid proxy")
+	ErrProxyAuthRequired = errors.New("proxy authentication required")
+	ErrProxyForbidden    = errors.New("proxy forbids the target")
+	ErrProxyUnavailable  = errors.New("proxy cannot reach the target")
+)
+
+const defaultConnectTimeout = 30 * time.Second
+
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+	// SchemeSOCKS5 resolves the target host locally.
+	SchemeSOCKS5 = "socks5"
+	// SchemeSOCKS5H lets the proxy resolve the target host.
+	SchemeSOCKS5H = "socks5h"
 )
 
 type Config struct {
+	// Scheme is one of the Scheme constants, SchemeHTTP when empty.
+	Scheme   string
 	Host     string
 	Port     string
 	Username string
 	Password string
+	// PasswordSource, when set, is used instead of Password.
+	PasswordSource secret.Source
+	// TLSConfig is used for the TLS connection to SchemeHTTPS proxies. The
+	// proxy certificate is verified for Host when nil.
+	TLSConfig *tls.Config
+	// Via is the proxy this one is reached through, for chains such as
+	// SOCKS5 then HTTP CONNECT.
+	Via *Config
+	// ConnectTimeout bounds the connection to HTTP proxies along with the
+	// TLS and CONNECT handshakes, 30 seconds by default.
+	ConnectTimeout time.Duration
+	// Header is added to CONNECT requests.
+	Header http.Header
+	// UserAgent of CONNECT requests, none when empty.
+	UserAgent string
+}
+
+// String describes the proxy without its password.
+func (c Config) String() string {
+	if c.Username == "" {
+		return fmt.Sprintf("%s://%s:%s", c.scheme(), c.Host, c.Port)
+	}
+	return fmt.Sprintf("%s://%s:***@%s:%s", c.scheme(), c.Username, c.Host, c.Port)
+}
+
+func (c *Config) scheme() string {
+	if c.Scheme == "" {
+		return SchemeHTTP
+	}
+	return strings.ToLower(c.Scheme)
 }
 
 func (c *Config) FromURL(rawURL string) error {
@@ -29,6 +81,7 @@ func (c *Config) FromURL(rawURL string) error {
 		return err
 	}
 
+	c.Scheme = proxyURL.Scheme
 	c.Host = proxyURL.Hostname()
 	c.Port = proxyURL.Port()
 	c.Username = proxyURL.User.Username()
@@ -37,6 +90,13 @@ func (c *Config) FromURL(rawURL string) error {
 	return nil
 }
 
+// Dialer is implemented by every dialer of the package.
+type Dialer = proxy.Dialer
+
+// ContextDialer is implemented by dialers honouring a context, net.Dialer
+// included.
+type ContextDialer = proxy.ContextDialer
+
 type direct struct{}
 
 // Direct is a direct proxy: one that makes network connections directly.
@@ -46,10 +106,64 @@ func (direct) Dial(network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
 
+func (direct) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// contextDialer turns a ContextDialer into a Dialer.
+type contextDialer struct {
+	ContextDialer
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// dialContext dials with d until ctx is done, even when d ignores contexts.
+func dialContext(ctx context.Context, d Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := d.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			// close the connection once the dial finally returns
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// FromContextDialer returns a Dialer dialing with d.
+func FromContextDialer(d ContextDialer) Dialer {
+	if pd, ok := d.(Dialer); ok {
+		return pd
+	}
+	return contextDialer{d}
+}
+
 // httpsDialer
 type httpsDialer struct{}
 
 // HTTPSDialer is a https proxy: one that makes network connections on tls.
+//
+// Deprecated: use a Config with SchemeHTTPS, which verifies the proxy.
 var HttpsDialer = httpsDialer{}
 var TlsConfig = &tls.Config{}
 
@@ -68,6 +182,11 @@ type httpProxy struct {
 	username string
 	password string
 	forward  proxy.Dialer
+	// tls is set for HTTPS proxies.
+	tls       *tls.Config
+	timeout   time.Duration
+	header    http.Header
+	userAgent string
 }
 
 func newHTTPProxy(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
@@ -79,57 +198,143 @@ func newHTTPProxy(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 		s.username = uri.User.Username()
 		s.password, _ = uri.User.Password()
 	}
+	if uri.Scheme == SchemeHTTPS {
+		s.tls = &tls.Config{ServerName: uri.Hostname()}
+	}
 
 	return s, nil
 }
 
 func (s *httpProxy) Dial(network, addr string) (net.Conn, error) {
-	// Dial and create the https client connection.
-	c, err := s.forward.Dial("tcp", s.host)
+	auth := ""
+	if s.haveAuth {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(s.username+":"+s.password))
+	}
+
+	c, resp, err := s.connect(addr, auth)
 	if err != nil {
 		return nil, err
 	}
 
-	// HACK. http.ReadRequest also does this.
-	reqURL, err := url.Parse("http://" + addr)
-	if err != nil {
+	if resp.StatusCode == http.StatusProxyAuthRequired && s.haveAuth {
+		if ch, ok := parseDigestChallenge(resp.Header.Values("Proxy-Authenticate")); ok {
+			// the proxy may close the connection after a 407, start over
+			c.Close()
+
+			c, resp, err = s.connect(addr, ch.authorization(s.username, s.password, http.MethodConnect, addr))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
 		c.Close()
-		return nil, err
+		return nil, &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-	reqURL.Scheme = ""
 
-	req, err := http.NewRequest("CONNECT", reqURL.String(), nil)
+	return c, nil
+}
+
+// connect opens a connection to the proxy and sends CONNECT, with auth as
+// the Proxy-Authorization header when set. The connection is returned
+// whatever the status of the response.
+func (s *httpProxy) connect(addr, auth string) (net.Conn, *http.Response, error) {
+	timeout := s.timeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Dial and create the https client connection.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	c, err := dialContext(ctx, s.forward, "tcp", s.host)
 	if err != nil {
-		c.Close()
-		return nil, err
+		return nil, nil, err
 	}
-	req.Close = false
-	if s.haveAuth {
-		req.SetBasicAuth(s.username, s.password)
+	c.SetDeadline(deadline)
+
+	if s.tls != nil {
+		tc := tls.Client(c, s.tls)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		c = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	// an empty User-Agent keeps net/http from sending its own
+	req.Header.Set("User-Agent", s.userAgent)
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
 	}
-	req.Header.Set("User-Agent", "Powerby Gota")
 
 	err = req.Write(c)
 	if err != nil {
 		c.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
-		// TODO close resp body ?
-		resp.Body.Close()
 		c.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		c.Close()
-		err = fmt.Errorf("Connect server using proxy error, StatusCode [%d]", resp.StatusCode)
-		return nil, err
+
+	c.SetDeadline(time.Time{})
+
+	// the proxy may have sent bytes of the tunnel along with the response
+	if br.Buffered() > 0 {
+		c = &bufferedConn{Conn: c, r: br}
 	}
 
-	return c, nil
+	return c, resp, nil
+}
+
+// bufferedConn reads what is left in r before reading the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ConnectError is a CONNECT request refused by a proxy. It matches
+// ErrProxyAuthRequired, ErrProxyForbidden and ErrProxyUnavailable with
+// errors.Is according to its status code.
+type ConnectError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("proxy refused CONNECT: %s", e.Status)
+}
+
+func (e *ConnectError) Is(target error) bool {
+	switch target {
+	case ErrProxyAuthRequired:
+		return e.StatusCode == http.StatusProxyAuthRequired
+	case ErrProxyForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrProxyUnavailable:
+		return e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
 }
 
 func FromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
@@ -140,25 +345,139 @@ func FromEnvironment() proxy.Dialer {
 	return proxy.FromEnvironment()
 }
 
+// NewHTTPDialer is kept for existing callers, it handles every scheme
+// NewDialer does.
 func NewHTTPDialer(config *Config) (proxy.Dialer, error) {
+	return NewDialer(config)
+}
+
+// maxChain bounds the length of a proxy chain, catching Via loops.
+const maxChain = 8
+
+// NewDialer returns a dialer going through the proxy described by config,
+// and the proxies it is reached through, or Direct when config is nil.
+func NewDialer(config *Config) (proxy.Dialer, error) {
+	return newDialer(config, Direct, 0)
+}
+
+// NewDialerVia is NewDialer with the first hop dialed by forward instead of
+// Direct, forward being returned as is when config is nil.
+func NewDialerVia(config *Config, forward proxy.Dialer) (proxy.Dialer, error) {
+	return newDialer(config, forward, 0)
+}
+
+func newDialer(config *Config, base proxy.Dialer, depth int) (proxy.Dialer, error) {
 	if config == nil {
-		return Direct, nil
+		return base, nil
+	}
+	if depth >= maxChain {
+		return nil, fmt.Errorf("%w: chain longer than %d proxies", ErrInvalidProxy, maxChain)
 	}
 
-	rawURL := fmt.Sprintf("http://%s:%s@%s:%s", config.Username, config.Password, config.Host, config.Port)
-	fmt.Println(rawURL)
+	forward, err := newDialer(config.Via, base, depth+1)
+	if err != nil {
+		return nil, err
+	}
 
-	proxyURL, err := url.Parse(rawURL)
+	password, err := secret.Resolve(context.Background(), config.PasswordSource, config.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	d, err := proxy.FromURL(proxyURL, Direct)
+	host := net.JoinHostPort(config.Host, config.Port)
+
+	switch config.scheme() {
+	case SchemeHTTP, SchemeHTTPS:
+		s := &httpProxy{
+			host:      host,
+			haveAuth:  config.Username != "" || password != "",
+			username:  config.Username,
+			password:  password,
+			forward:   forward,
+			timeout:   config.ConnectTimeout,
+			header:    config.Header,
+			userAgent: config.UserAgent,
+		}
+		if config.scheme() == SchemeHTTPS {
+			s.tls = config.TLSConfig
+			if s.tls == nil {
+				s.tls = &tls.Config{}
+			}
+			if s.tls.ServerName == "" {
+				s.tls = s.tls.Clone()
+				s.tls.ServerName = config.Host
+			}
+		}
+
+		return s, nil
+	case SchemeSOCKS5, SchemeSOCKS5H:
+		var auth *proxy.Auth
+		if config.Username != "" || password != "" {
+			auth = &proxy.Auth{User: config.Username, Password: password}
+		}
+
+		d, err := proxy.SOCKS5("tcp", host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		if config.scheme() == SchemeSOCKS5 {
+			return &localResolver{forward: d, resolver: resolverOf(base)}, nil
+		}
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidProxy, config.Scheme)
+}
+
+// Resolver resolves the targets of socks5 proxies, which must not see host
+// names. A first hop dialer implementing it is used for that, with
+// FromContextDialer or not, net.DefaultResolver otherwise.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// resolverOf returns the resolver of the first hop dialer d.
+func resolverOf(d proxy.Dialer) Resolver {
+	if cd, ok := d.(contextDialer); ok {
+		if r, ok := cd.ContextDialer.(Resolver); ok {
+			return r
+		}
+	}
+	if r, ok := d.(Resolver); ok {
+		return r
+	}
+	return net.DefaultResolver
+}
+
+// localResolver resolves the target host before handing it to forward, for
+// proxies that must not see host names.
+type localResolver struct {
+	forward  proxy.Dialer
+	resolver Resolver
+}
+
+func (d *localResolver) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *localResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return d, nil
+	if net.ParseIP(host) == nil {
+		ips, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no address found", Name: host, IsNotFound: true}
+		}
+		addr = net.JoinHostPort(ips[0].IP.String(), port)
+	}
+
+	return dialContext(ctx, d.forward, network, addr)
 }
 
 func init() {
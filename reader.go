@@ -3,15 +3,22 @@ package mailreader
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/New-Moon-Team/gomailreader/proxy"
+	"github.com/New-Moon-Team/gomailreader/secret"
 )
 
+// Reader is what the IMAP and POP3 readers have in common. GetLatestMsgOf
+// and WaitForMessage write the ImapMail shape whatever the protocol. The
+// unexported methods keep it implemented by this package only, which lets
+// methods be added to it, as WaitForMessage was.
 type Reader interface {
 	BoxGetAll(box MailBox, res *[]byte) error
 	GetAllBoxes() error
 	GetLatestMsgOf(ctx context.Context, res *[]byte, box, receiver string) error
+	WaitForMessage(ctx context.Context, res *[]byte, box string, pred MessagePredicate, opts WaitOptions) error
 	log(l string)
 	warn(w string)
 }
@@ -20,7 +27,86 @@ type ReaderConfig struct {
 	Server   ServerMail
 	User     string
 	Password string
-	Proxy    *proxy.Config
+	// PasswordSource, when set, is resolved on every connection and used
+	// instead of Password.
+	PasswordSource secret.Source
+	Proxy          *proxy.Config
+	// ProxyPool, when set, is used instead of Proxy. Connections of the
+	// account are bound to it with Pool.ForAccount, the pool dials the
+	// proxies with its own PoolOptions.Forward.
+	ProxyPool *proxy.Pool
+	// Dialer makes the network connections, to the server or the first
+	// proxy. It is built from Net when nil. The readers need one of Proxy,
+	// ProxyPool, Dialer or Net, ErrNoProxy is returned otherwise.
+	Dialer proxy.ContextDialer
+	// Net tunes the default dialer, see NetOptions.
+	Net *NetOptions
+	// Port overrides the default port of the protocol and security.
+	Port int
+	// Security tells how the connection is protected, SecurityTLS by default.
+	Security Security
+	// Auth forces an authentication mechanism. Otherwise POP3 tries APOP
+	// first on a connection without TLS when the server offers it, then
+	// SASL PLAIN and LOGIN when offered, then USER/PASS, moving on only when
+	// the server refuses a mechanism, not the credentials. IMAP uses LOGIN
+	// unless TokenSource is set.
+	Auth AuthMechanism
+	// TLS tunes certificate verification, see TLSOptions.
+	TLS *TLSOptions
+	// TokenSource enables OAuth2 authentication, with XOAUTH2 or
+	// OAUTHBEARER. Password is not used then.
+	TokenSource TokenSource
+	// Limits bounds what is read of a message, DefaultLimits when nil.
+	Limits *Limits
+}
+
+// String describes the account without its secrets.
+func (c ReaderConfig) String() string {
+	return fmt.Sprintf("%v@%v", c.User, c.Server)
+}
+
+// hasRoute reports whether the account says how to reach the server: a
+// proxy, a pool, a dialer or network options. The readers refuse to
+// connect without one, ErrNoProxy being returned.
+func (c *ReaderConfig) hasRoute() bool {
+	return c.Proxy != nil || c.ProxyPool != nil || c.Dialer != nil || c.Net != nil
+}
+
+// dialer returns the dialer connections to the server go through.
+func (c *ReaderConfig) dialer() (proxy.Dialer, error) {
+	if c.ProxyPool != nil {
+		return c.ProxyPool.ForAccount(c.User), nil
+	}
+	d, err := c.netDialer()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewDialerVia(c.Proxy, proxy.FromContextDialer(d))
+}
+
+// password resolves the password of the account.
+func (c *ReaderConfig) password(ctx context.Context) (string, error) {
+	return secret.Resolve(ctx, c.PasswordSource, c.Password)
+}
+
+// port returns the port to dial, tlsPort and plainPort being the default
+// ports of the protocol with implicit TLS and without.
+func (c *ReaderConfig) port(tlsPort, plainPort int) int {
+	if c.Port != 0 {
+		return c.Port
+	}
+	if c.implicitTLS() {
+		return tlsPort
+	}
+	return plainPort
+}
+
+func (c *ReaderConfig) addr(tlsPort, plainPort int) string {
+	return fmt.Sprintf("%v:%d", c.Server, c.port(tlsPort, plainPort))
+}
+
+func (c *ReaderConfig) implicitTLS() bool {
+	return c.Security == "" || c.Security == SecurityTLS
 }
 
 var (
@@ -30,6 +116,40 @@ var (
 	ErrInvalidBox               = errors.New("invalid box")
 	ErrInvalidResponse          = errors.New("invalid response")
 	ErrNoLogger                 = errors.New("no logger")
+	ErrWaitTimeout              = errors.New("timed out waiting for message")
+	ErrMessageNotFound          = errors.New("message not found")
+	ErrStartTLSNotSupported     = errors.New("server does not support STARTTLS")
+	ErrAuthNotSupported         = errors.New("authentication mechanism not supported")
+	ErrCertificatePinMismatch   = errors.New("no pinned key in certificate chain")
+	ErrAttachmentNotFound       = errors.New("attachment not found")
+	ErrMessageTooLarge          = errors.New("message too large")
+	ErrTooManyParts             = errors.New("too many parts")
+	ErrTooDeep                  = errors.New("parts nested too deep")
+	ErrDecodedTooLarge          = errors.New("decoded content too large")
+	ErrHeaderTooLarge           = errors.New("header too large")
+	ErrInvalidNetOptions        = errors.New("invalid network options")
+)
+
+type Security string
+
+var (
+	// SecurityTLS uses implicit TLS, on port 993 for IMAP and 995 for POP3.
+	SecurityTLS Security = "tls"
+	// SecurityStartTLS upgrades a plain connection with STARTTLS or STLS.
+	SecurityStartTLS Security = "starttls"
+	// SecurityNone sends everything in clear, only meant for local servers.
+	SecurityNone Security = "none"
+)
+
+type AuthMechanism string
+
+var (
+	AuthUser        AuthMechanism = "USER"
+	AuthAPOP        AuthMechanism = "APOP"
+	AuthPlain       AuthMechanism = "PLAIN"
+	AuthLogin       AuthMechanism = "LOGIN"
+	AuthXOAuth2     AuthMechanism = "XOAUTH2"
+	AuthOAuthBearer AuthMechanism = "OAUTHBEARER"
 )
 
 type ReaderType string
@@ -64,12 +184,20 @@ const (
 )
 
 type ImapMailPart struct {
+	// Path locates the part in the MIME tree, see MimePart.
+	Path        string
 	ContentType string
-	Content     string
+	// Charset is the charset the part was sent in, Content is UTF-8.
+	Charset string
+	Content string
 }
 type Pop3MailPart struct {
+	// Path locates the part in the MIME tree, see MimePart.
+	Path        string
 	ContentType string
-	Content     string
+	// Charset is the charset the part was sent in, Content is UTF-8.
+	Charset string
+	Content string
 }
 type ImapMail struct {
 	Uid uint32 `json:"uid"`
@@ -89,18 +217,27 @@ type ImapMail struct {
 	Cc []string `json:"cc"`
 	// The Bcc header addresses.
 	Bcc []string `json:"bcc"`
+	// Names maps the addresses above to their decoded display names.
+	Names map[string]string `json:"names,omitempty"`
 	// The In-Reply-To header. Contains the parent Message-Id.
 	InReplyTo string `json:"in_reply_to"`
 	// The Message-Id header.
-	MessageId  string         `json:"message_id"`
-	Parts      []ImapMailPart `json:"parts"`
-	Box        string         `json:"box"`
-	ScantAt    time.Time      `json:"scant_at"`
-	ScanMethod string         `json:"scan_method"`
-	Email      string         `json:"email"`
+	MessageId string         `json:"message_id"`
+	Parts     []ImapMailPart `json:"parts"`
+	// Attachments describes the attached files, left out of Parts.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Truncated is set when the message broke one of the Limits, the
+	// reason telling which. It holds what was read within them.
+	Truncated       bool      `json:"truncated,omitempty"`
+	TruncatedReason string    `json:"truncated_reason,omitempty"`
+	Box             string    `json:"box"`
+	ScantAt         time.Time `json:"scant_at"`
+	ScanMethod      string    `json:"scan_method"`
+	Email           string    `json:"email"`
 }
 type Pop3Mail struct {
-	Uid uint32 `json:"uid"`
+	// The UIDL of the message.
+	Uid string `json:"uid"`
 	// The message date.
 	Date string `json:"date"`
 	// The message subject.
@@ -120,12 +257,36 @@ type Pop3Mail struct {
 	// The In-Reply-To header. Contains the parent Message-Id.
 	InReplyTo string `json:"in_reply_to"`
 	// The Message-Id header.
-	MessageId  string         `json:"message_id"`
-	Parts      []Pop3MailPart `json:"parts"`
-	Box        string         `json:"box"`
-	ScantAt    time.Time      `json:"scant_at"`
-	ScanMethod string         `json:"scan_method"`
-	Email      string         `json:"email"`
+	MessageId string         `json:"message_id"`
+	Parts     []Pop3MailPart `json:"parts"`
+	// Attachments describes the attached files, left out of Parts.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Truncated is set when the message broke one of the Limits, the
+	// reason telling which. It holds what was read within them.
+	Truncated       bool      `json:"truncated,omitempty"`
+	TruncatedReason string    `json:"truncated_reason,omitempty"`
+	Box             string    `json:"box"`
+	ScantAt         time.Time `json:"scant_at"`
+	ScanMethod      string    `json:"scan_method"`
+	Email           string    `json:"email"`
+}
+
+// Pop3MailSummary is what a POP3 headers only scan returns for a message.
+type Pop3MailSummary struct {
+	// The message number, only valid until the next session.
+	Number int `json:"number"`
+	// The UIDL of the message, empty when the server has no UIDL.
+	Uid string `json:"uid"`
+	// The message size in octets, as reported by LIST.
+	Size      int64  `json:"size"`
+	Date      string `json:"date"`
+	Subject   string `json:"subject"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Cc        string `json:"cc"`
+	MessageId string `json:"message_id"`
+	// The first body lines, undecoded.
+	Preview string `json:"preview,omitempty"`
 }
 
 func GetReader(t ReaderType, cfg *ReaderConfig) (Reader, error) {
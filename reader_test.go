@@ -0,0 +1,28 @@
+package mailreader
+
+import (
+	"testing"
+
+	"github.com/New-Moon-Team/gomailreader/proxy"
+)
+
+func TestHasRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ReaderConfig
+		want bool
+	}{
+		{"none", ReaderConfig{}, false},
+		{"proxy", ReaderConfig{Proxy: &proxy.Config{Host: "127.0.0.1", Port: "8080"}}, true},
+		{"dialer", ReaderConfig{Dialer: proxy.Direct}, true},
+		{"net options", ReaderConfig{Net: &NetOptions{LocalAddr: "192.0.2.1"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.hasRoute(); got != tt.want {
+				t.Errorf("hasRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package mailreader
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// recipientHeaders are the headers that can carry the address a message was
+// delivered to. Delivery headers come first since they survive Bcc.
+var recipientHeaders = []string{"Delivered-To", "X-Original-To", "Envelope-To", "To", "Cc"}
+
+var receivedForRe = regexp.MustCompile(`(?i)\bfor\s+<?([^\s<>;()]+@[^\s<>;()]+)>?`)
+
+// RecipientRules tells how loosely a receiver address is compared with the
+// recipients of a message. The zero value compares addresses exactly, apart
+// from the domain which is always case-insensitive.
+//
+// A receiver written as "@example.com" or "*@example.com" matches any
+// address of that domain, which is handy for catch-all mailboxes.
+type RecipientRules struct {
+	// IgnoreCase compares local parts case-insensitively.
+	IgnoreCase bool
+	// IgnorePlusTag drops the "+tag" suffix of local parts.
+	IgnorePlusTag bool
+	// IgnoreDots drops the dots of local parts, as Gmail does.
+	IgnoreDots bool
+}
+
+// Normalize rewrites addr according to the rules.
+func (rr RecipientRules) Normalize(addr string) string {
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return addr
+	}
+
+	if rr.IgnorePlusTag {
+		local, _, _ = strings.Cut(local, "+")
+	}
+	if rr.IgnoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	if rr.IgnoreCase {
+		local = strings.ToLower(local)
+	}
+
+	return local + "@" + strings.ToLower(domain)
+}
+
+// Match reports whether receiver is one of the recipients found in h.
+func (rr RecipientRules) Match(h mail.Header, receiver string) bool {
+	want := rr.Normalize(strings.TrimPrefix(receiver, "*"))
+	catchAll := strings.HasPrefix(want, "@")
+
+	for _, a := range MessageRecipients(h) {
+		got := rr.Normalize(a)
+		if got == want || catchAll && strings.HasSuffix(got, want) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MessageRecipients lists every address h says the message was delivered to:
+// the Delivered-To, X-Original-To, Envelope-To, To and Cc headers and the
+// "for" clause of the Received headers.
+func MessageRecipients(h mail.Header) []string {
+	var addrs []string
+
+	for _, key := range recipientHeaders {
+		addrs = append(addrs, headerAddresses(h, key)...)
+	}
+
+	for _, v := range h["Received"] {
+		// folded headers keep their line breaks
+		v = strings.Join(strings.Fields(v), " ")
+		for _, m := range receivedForRe.FindAllStringSubmatch(v, -1) {
+			addrs = append(addrs, m[1])
+		}
+	}
+
+	return addrs
+}
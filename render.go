@@ -0,0 +1,371 @@
+package mailreader
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// RenderOptions tunes RenderHTML.
+type RenderOptions struct {
+	// BlockRemote removes what the document would load from the network:
+	// remote images, stylesheets, fonts, frames and SVG resources. Links
+	// are kept.
+	BlockRemote bool
+}
+
+// blockRemoteCSP backs BlockRemote up in the browsers honouring it.
+const blockRemoteCSP = "default-src 'none'; img-src data:; media-src data:; font-src data:; style-src 'unsafe-inline' data:"
+
+// RenderMessage reads the raw message msg and renders it with RenderHTML.
+// DefaultLimits apply, a message they cut short renders what was read.
+func RenderMessage(msg io.Reader, opts RenderOptions) (string, error) {
+	return renderMessage(msg, opts, DefaultLimits)
+}
+
+func renderMessage(msg io.Reader, opts RenderOptions, limits Limits) (string, error) {
+	limits = limits.withDefaults()
+	m, err := readMessage(msg, limits.MaxHeaderSize)
+	if err != nil && !errors.Is(err, ErrHeaderTooLarge) {
+		return "", err
+	}
+
+	tree, err := ParseMimeTreeLimits(m, limits)
+	if err != nil {
+		return "", err
+	}
+	return tree.RenderHTML(opts)
+}
+
+// RenderHTML returns the HTML body of the message p is the root of as a
+// self-contained document: cid: references to related parts become data
+// URIs, scripts, event handlers, javascript: and vbscript: URLs and meta
+// refreshes are dropped, and the charset is UTF-8. A message without
+// HTML body gets its text body wrapped in a pre element.
+func (p *MimePart) RenderHTML(opts RenderOptions) (string, error) {
+	var body, text *MimePart
+	resources := make(map[string]*MimePart)
+	for _, l := range p.Leaves() {
+		if id := strings.Trim(l.Header.Get("Content-Id"), "<> \t"); id != "" {
+			resources["cid:"+strings.ToLower(id)] = l
+		}
+		if loc := strings.TrimSpace(l.Header.Get("Content-Location")); loc != "" {
+			resources[loc] = l
+		}
+
+		switch {
+		case l.IsAttachment():
+		case l.ContentType == "text/html" && body == nil:
+			body = l
+		case l.ContentType == "text/plain" && text == nil:
+			text = l
+		}
+	}
+
+	src := "<pre>" + html.EscapeString(strings.ReplaceAll(textOf(text), "\r\n", "\n")) + "</pre>"
+	if body != nil {
+		src = body.Content
+	}
+
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+
+	r := &htmlRenderer{opts: opts, resources: resources}
+	r.node(doc)
+	r.head(doc)
+
+	var b strings.Builder
+	if err := html.Render(&b, doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func textOf(p *MimePart) string {
+	if p == nil {
+		return ""
+	}
+	return p.Content
+}
+
+// htmlRenderer rewrites the nodes of an HTML body.
+type htmlRenderer struct {
+	opts      RenderOptions
+	resources map[string]*MimePart
+}
+
+var cssURLRe = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+var cssImportRe = regexp.MustCompile(`(?i)@import\s+(?:url\(\s*['"]?([^'")]*)['"]?\s*\)|'([^']*)'|"([^"]*)")[^;]*;?`)
+
+// urlAttrs lists the attributes loading a resource.
+var urlAttrs = map[string]bool{
+	"src":        true,
+	"background": true,
+	"poster":     true,
+	"data":       true,
+	"srcset":     true,
+}
+
+// linkAttrs lists the attributes holding a URL only followed on demand.
+// xlink:href is parsed as href in the xlink namespace.
+var linkAttrs = map[string]bool{
+	"href":       true,
+	"action":     true,
+	"formaction": true,
+	"cite":       true,
+	"longdesc":   true,
+}
+
+func (r *htmlRenderer) node(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if r.drop(c) {
+			n.RemoveChild(c)
+		} else {
+			r.node(c)
+		}
+		c = next
+	}
+
+	if n.Type != html.ElementNode {
+		if n.Type == html.TextNode && n.Parent != nil && n.Parent.DataAtom == atom.Style {
+			n.Data = r.css(n.Data)
+		}
+		return
+	}
+
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"), key == "srcdoc":
+			// event handlers are scripts, inline frames whole documents
+			continue
+		case key == "style":
+			a.Val = r.css(a.Val)
+		case key == "srcset":
+			a.Val = r.srcset(a.Val)
+			if a.Val == "" {
+				continue
+			}
+		case urlAttrs[key], key == "href" && (n.DataAtom == atom.Link || svgResource(n)):
+			v, ok := r.resolve(a.Val)
+			if !ok {
+				continue
+			}
+			a.Val = v
+		case linkAttrs[key] && scriptURL(a.Val):
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// drop reports whether n is removed from the document.
+func (r *htmlRenderer) drop(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+
+	if n.Namespace == "svg" && (n.Data == "animate" || n.Data == "set") {
+		// they can turn a link into a script
+		name := strings.ToLower(attr(n, "attributeName"))
+		return name == "href" || name == "xlink:href"
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Noscript:
+		return true
+	case atom.Base:
+		return r.opts.BlockRemote
+	case atom.Meta:
+		// the charset is set again, refreshes would load a page
+		_, charset := attrOk(n, "charset")
+		equiv := strings.ToLower(attr(n, "http-equiv"))
+		return charset || equiv == "content-type" || equiv == "refresh"
+	case atom.Link:
+		_, ok := r.resolve(attr(n, "href"))
+		return !ok
+	case atom.Iframe, atom.Frame, atom.Object, atom.Embed:
+		return r.opts.BlockRemote && (remoteURL(attr(n, "src")) || remoteURL(attr(n, "data")))
+	}
+	return false
+}
+
+// resolve returns the value of an attribute loading the resource v, false
+// when it must be removed.
+func (r *htmlRenderer) resolve(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if scriptURL(v) {
+		return "", false
+	}
+	if p := r.resource(v); p != nil {
+		return dataURI(p), true
+	}
+	if r.opts.BlockRemote && remoteURL(v) {
+		return "", false
+	}
+	return v, true
+}
+
+// resource returns the part a cid: URL or a Content-Location names.
+func (r *htmlRenderer) resource(v string) *MimePart {
+	if len(v) > 4 && strings.EqualFold(v[:4], "cid:") {
+		id, err := url.PathUnescape(v[4:])
+		if err != nil {
+			id = v[4:]
+		}
+		return r.resources["cid:"+strings.ToLower(strings.Trim(id, "<>"))]
+	}
+	return r.resources[v]
+}
+
+// srcset resolves the candidates of a srcset attribute. A candidate URL
+// ends at a space, commas included, the way data URIs need.
+func (r *htmlRenderer) srcset(v string) string {
+	var out []string
+	for {
+		v = strings.TrimLeft(v, " \t\r\n\f,")
+		if v == "" {
+			break
+		}
+
+		u, rest, _ := strings.Cut(strings.Map(func(r rune) rune {
+			if strings.ContainsRune("\t\r\n\f", r) {
+				return ' '
+			}
+			return r
+		}, v), " ")
+		descriptors := ""
+		if trimmed := strings.TrimRight(u, ","); trimmed != u {
+			// no descriptors
+			u, v = trimmed, rest
+		} else {
+			descriptors, v, _ = strings.Cut(rest, ",")
+		}
+
+		u, ok := r.resolve(u)
+		if !ok {
+			continue
+		}
+		out = append(out, strings.Join(append([]string{u}, strings.Fields(descriptors)...), " "))
+	}
+	return strings.Join(out, ", ")
+}
+
+// css resolves the url() of a stylesheet or style attribute.
+func (r *htmlRenderer) css(s string) string {
+	if r.opts.BlockRemote {
+		s = cssImportRe.ReplaceAllStringFunc(s, func(imp string) string {
+			m := cssImportRe.FindStringSubmatch(imp)
+			if remoteURL(m[1] + m[2] + m[3]) {
+				return ""
+			}
+			return imp
+		})
+	}
+
+	return cssURLRe.ReplaceAllStringFunc(s, func(u string) string {
+		m := cssURLRe.FindStringSubmatch(u)
+		v, ok := r.resolve(m[2])
+		if !ok {
+			return "none"
+		}
+		return "url(" + m[1] + v + m[3] + ")"
+	})
+}
+
+// head sets the charset of the document, and the content security policy
+// with BlockRemote.
+func (r *htmlRenderer) head(doc *html.Node) {
+	head := findElement(doc, atom.Head)
+	if head == nil {
+		return
+	}
+
+	if r.opts.BlockRemote {
+		head.InsertBefore(&html.Node{
+			Type:     html.ElementNode,
+			Data:     "meta",
+			DataAtom: atom.Meta,
+			Attr: []html.Attribute{
+				{Key: "http-equiv", Val: "Content-Security-Policy"},
+				{Key: "content", Val: blockRemoteCSP},
+			},
+		}, head.FirstChild)
+	}
+	head.InsertBefore(&html.Node{
+		Type:     html.ElementNode,
+		Data:     "meta",
+		DataAtom: atom.Meta,
+		Attr:     []html.Attribute{{Key: "charset", Val: "utf-8"}},
+	}, head.FirstChild)
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// svgResource reports whether the href of n, an SVG element, loads a
+// resource rather than being a link.
+func svgResource(n *html.Node) bool {
+	return n.Namespace == "svg" && n.Data != "a"
+}
+
+// scriptURL reports whether v runs a script, read the way browsers do:
+// line breaks and tabs ignored, leading spaces and controls trimmed.
+func scriptURL(v string) bool {
+	v = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, v)
+	v = strings.ToLower(strings.TrimLeftFunc(v, func(r rune) bool { return r <= ' ' }))
+	return strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "vbscript:")
+}
+
+// remoteURL reports whether loading v goes to the network.
+func remoteURL(v string) bool {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if strings.HasPrefix(v, "//") {
+		return true
+	}
+
+	u, err := url.Parse(v)
+	if err != nil {
+		// unparsable, better not load it
+		return true
+	}
+	switch u.Scheme {
+	case "", "data", "cid", "about":
+		return false
+	}
+	return true
+}
+
+// dataURI encodes the content of p, converted to UTF-8 for text parts.
+func dataURI(p *MimePart) string {
+	mediaType := p.ContentType
+	if strings.HasPrefix(mediaType, "text/") && !p.IsAttachment() {
+		mediaType += ";charset=utf-8"
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString([]byte(p.Content))
+}
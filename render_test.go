@@ -0,0 +1,111 @@
+package mailreader
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		blockRemote bool
+		want        []string
+		dropped     []string
+	}{
+		{
+			name:    "scripts",
+			body:    `<p onclick="alert(1)">hi</p><script>alert(2)</script><noscript>x</noscript>`,
+			want:    []string{"<p>hi</p>"},
+			dropped: []string{"alert", "noscript"},
+		},
+		{
+			name:    "javascript links",
+			body:    `<a href="javascript:alert(1)">a</a><a href=" JaVa&#09;Script:alert(2)">b</a><map><area href="vbscript:msgbox(3)"></map><a href="https://example.com/">c</a>`,
+			want:    []string{`<a>a</a>`, `<a>b</a>`, `<area/>`, `<a href="https://example.com/">c</a>`},
+			dropped: []string{"alert", "msgbox"},
+		},
+		{
+			name:    "form actions",
+			body:    `<form action="javascript:alert(1)"><button formaction="javascript:alert(2)">go</button><input formaction="vbscript:msgbox(3)"></form>`,
+			want:    []string{"<form><button>go</button><input/></form>"},
+			dropped: []string{"alert", "msgbox"},
+		},
+		{
+			name:    "frames",
+			body:    `<iframe src="javascript:alert(1)"></iframe><iframe srcdoc="<script>alert(2)</script>"></iframe>`,
+			want:    []string{"<iframe></iframe><iframe></iframe>"},
+			dropped: []string{"alert"},
+		},
+		{
+			name:    "css",
+			body:    `<div style="background: url(javascript:alert(1))">x</div>`,
+			want:    []string{`style="background: none`},
+			dropped: []string{"alert"},
+		},
+		{
+			name:    "meta refresh",
+			body:    `<html><head><meta http-equiv="refresh" content="0;url=https://example.com/"></head><body>x</body></html>`,
+			dropped: []string{"refresh"},
+		},
+		{
+			name:    "svg links",
+			body:    `<svg><a href="javascript:alert(1)"><text>a</text></a><a xlink:href="javascript:alert(2)"><text>b</text></a><a href="https://example.com/"><text>c</text></a></svg>`,
+			want:    []string{`<a href="https://example.com/">`},
+			dropped: []string{"alert"},
+		},
+		{
+			name:    "svg animation",
+			body:    `<svg><a><animate attributeName="href" values="javascript:alert(1)"></animate><set attributeName="xlink:href" to="javascript:alert(2)"></set><animate attributeName="opacity" values="0;1"></animate><text>a</text></a></svg>`,
+			want:    []string{`attributeName="opacity"`},
+			dropped: []string{"alert"},
+		},
+		{
+			name:    "svg resources kept",
+			body:    `<svg><image href="https://example.com/a.png"></image></svg>`,
+			want:    []string{`href="https://example.com/a.png"`},
+			dropped: []string{"Content-Security-Policy"},
+		},
+		{
+			name:        "svg resources blocked",
+			body:        `<svg><image href="https://example.com/a.png"></image><use xlink:href="https://example.com/b.svg#c"></use><image href="data:image/png;base64,AA=="></image></svg>`,
+			blockRemote: true,
+			want:        []string{`<image href="data:image/png;base64,AA=="></image>`, "Content-Security-Policy"},
+			dropped:     []string{"example.com"},
+		},
+		{
+			name:    "srcset",
+			body:    `<img srcset="a.png, b.png 2x,c.png 3x"><img srcset="data:image/png;base64,AA==, javascript:alert(1) 2x">`,
+			want:    []string{`<img srcset="a.png, b.png 2x, c.png 3x"/>`, `<img srcset="data:image/png;base64,AA=="/>`},
+			dropped: []string{"alert"},
+		},
+		{
+			name:        "remote images blocked",
+			body:        `<img src="https://example.com/p.gif"><img srcset="https://example.com/a.png 1x, data:image/png;base64,AA== 2x"><a href="https://example.com/">link</a>`,
+			blockRemote: true,
+			want:        []string{`<img/>`, `<img srcset="data:image/png;base64,AA== 2x"/>`, `<a href="https://example.com/">link</a>`},
+			dropped:     []string{"p.gif", "a.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &MimePart{Path: "1", ContentType: "text/html", Header: textproto.MIMEHeader{}, Content: tt.body}
+			doc, err := p.RenderHTML(RenderOptions{BlockRemote: tt.blockRemote})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(doc, w) {
+					t.Errorf("%q not in %v", w, doc)
+				}
+			}
+			for _, d := range tt.dropped {
+				if strings.Contains(doc, d) {
+					t.Errorf("%q left in %v", d, doc)
+				}
+			}
+		})
+	}
+}
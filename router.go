@@ -0,0 +1,343 @@
+package mailreader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Router shares one IMAP watcher per real mailbox between any number of
+// virtual inboxes, one per recipient address. It is meant for catch-all
+// mailboxes receiving mail for many disposable addresses, where running one
+// GetLatestMsgOf per address would open as many connections.
+type Router struct {
+	rules    RecipientRules
+	interval time.Duration
+
+	mu       sync.Mutex
+	watchers map[string]*watcher
+	inboxes  map[string]map[*VirtualInbox]bool
+}
+
+type RouterOptions struct {
+	// Rules tells how message recipients are matched with subscriptions.
+	Rules RecipientRules
+	// PollInterval is the delay between two mailbox checks.
+	PollInterval time.Duration
+}
+
+func NewRouter(opts RouterOptions) *Router {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+
+	return &Router{
+		rules:    opts.Rules,
+		interval: opts.PollInterval,
+		watchers: make(map[string]*watcher),
+		inboxes:  make(map[string]map[*VirtualInbox]bool),
+	}
+}
+
+// Watch starts routing the messages delivered to box of r from now on, until
+// ctx is done. Watching a mailbox already watched does nothing.
+func (rt *Router) Watch(ctx context.Context, r *ImapReader, box string) {
+	key := fmt.Sprintf("%v/%v/%v", r.Server, r.User, box)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, ok := rt.watchers[key]; ok {
+		return
+	}
+
+	w := &watcher{
+		rt:    rt,
+		r:     r,
+		box:   box,
+		acked: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	rt.watchers[key] = w
+
+	go func() {
+		w.run(ctx)
+
+		rt.mu.Lock()
+		delete(rt.watchers, key)
+		rt.mu.Unlock()
+		close(w.done)
+	}()
+}
+
+// Subscribe registers a virtual inbox receiving the messages sent to
+// receiver. Up to size messages are buffered, newer ones are dropped while
+// the buffer is full. A receiver of the form "@example.com" gets every
+// message of the domain.
+func (rt *Router) Subscribe(receiver string, size int) *VirtualInbox {
+	in := &VirtualInbox{
+		rt:  rt,
+		key: rt.rules.Normalize(strings.TrimPrefix(receiver, "*")),
+		ch:  make(chan *RoutedMail, size),
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.inboxes[in.key] == nil {
+		rt.inboxes[in.key] = make(map[*VirtualInbox]bool)
+	}
+	rt.inboxes[in.key][in] = true
+
+	return in
+}
+
+// route hands a fetched message to every virtual inbox it is addressed to.
+func (rt *Router) route(w *watcher, m *imapCandidate) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	targets := make(map[*VirtualInbox]bool)
+	for _, a := range MessageRecipients(m.header) {
+		n := rt.rules.Normalize(a)
+		for in := range rt.inboxes[n] {
+			targets[in] = true
+		}
+		if _, domain, ok := strings.Cut(n, "@"); ok {
+			for in := range rt.inboxes["@"+domain] {
+				targets[in] = true
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	// counted before sending, an inbox may ack before the others get theirs
+	d := &delivery{w: w, uid: m.uid}
+	d.pending.Store(int32(len(targets)))
+	for in := range targets {
+		select {
+		case in.ch <- &RoutedMail{Mail: m.mail, delivery: d}:
+		default:
+			d.pending.Add(-1)
+			w.r.warn(fmt.Sprintf("Warn: inbox of %v is full, dropping uid %d", in.key, m.uid))
+		}
+	}
+}
+
+// VirtualInbox receives the messages routed to one recipient address.
+type VirtualInbox struct {
+	rt   *Router
+	key  string
+	ch   chan *RoutedMail
+	once sync.Once
+}
+
+// Messages returns the channel the routed messages are sent on. It is closed
+// by Close.
+func (in *VirtualInbox) Messages() <-chan *RoutedMail {
+	return in.ch
+}
+
+// Close unregisters the inbox.
+func (in *VirtualInbox) Close() {
+	in.once.Do(func() {
+		in.rt.mu.Lock()
+		defer in.rt.mu.Unlock()
+
+		delete(in.rt.inboxes[in.key], in)
+		if len(in.rt.inboxes[in.key]) == 0 {
+			delete(in.rt.inboxes, in.key)
+		}
+		close(in.ch)
+	})
+}
+
+// RoutedMail is a message handed to a virtual inbox.
+type RoutedMail struct {
+	Mail *ImapMail
+
+	delivery *delivery
+	once     sync.Once
+}
+
+// Ack acknowledges the message for this inbox. The message is flagged as
+// seen on the server once every inbox it was routed to acknowledged it.
+func (m *RoutedMail) Ack() {
+	m.once.Do(m.delivery.ack)
+}
+
+// delivery tracks the acknowledgements of a message routed to several inboxes.
+type delivery struct {
+	w       *watcher
+	uid     uint32
+	pending atomic.Int32
+}
+
+func (d *delivery) ack() {
+	if d.pending.Add(-1) > 0 {
+		return
+	}
+
+	select {
+	case <-d.w.done:
+		return
+	default:
+	}
+
+	// queued without blocking, the watcher may be reconnecting
+	d.w.mu.Lock()
+	d.w.acks = append(d.w.acks, d.uid)
+	d.w.mu.Unlock()
+
+	select {
+	case d.w.acked <- struct{}{}:
+	default:
+	}
+}
+
+// watcher polls one mailbox and routes the new messages.
+type watcher struct {
+	rt   *Router
+	r    *ImapReader
+	box  string
+	next uint32
+	done chan struct{}
+
+	// acks holds the uids to flag as seen, acked tells there are some
+	mu    sync.Mutex
+	acks  []uint32
+	acked chan struct{}
+}
+
+// flagAcked flags the acknowledged messages as seen. They are kept for the
+// next session when it fails.
+func (w *watcher) flagAcked(c *client.Client) error {
+	w.mu.Lock()
+	uids := w.acks
+	w.acks = nil
+	w.mu.Unlock()
+
+	if len(uids) == 0 {
+		return nil
+	}
+	if err := markSeen(c, uids...); err != nil {
+		w.mu.Lock()
+		w.acks = append(uids, w.acks...)
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (w *watcher) run(ctx context.Context) {
+	for {
+		err := w.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		w.r.warn(fmt.Sprintf("Warn: watching box %v error %v", w.box, err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.rt.interval):
+		}
+	}
+}
+
+// session runs one IMAP connection until ctx is done or an error occurs.
+func (w *watcher) session(ctx context.Context) error {
+	c, err := w.r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	w.r.log(fmt.Sprintf("Selecting box: %v", w.box))
+	mbox, err := c.Select(w.box, false)
+	if err != nil {
+		return err
+	}
+	if w.next == 0 {
+		w.next = mbox.UidNext
+	}
+
+	ticker := time.NewTicker(w.rt.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(c); err != nil {
+			return err
+		}
+		if err := w.flagAcked(c); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.acked:
+			// flagged at the top of the loop
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll routes the messages with a uid not seen yet.
+func (w *watcher) poll(c *client.Client) error {
+	if err := c.Noop(); err != nil {
+		return err
+	}
+
+	cr := imap.NewSearchCriteria()
+	cr.Uid = new(imap.SeqSet)
+	cr.Uid.AddRange(w.next, 0)
+
+	uids, err := c.UidSearch(cr)
+	if err != nil {
+		return err
+	}
+
+	seeding := w.next == 0
+	var fresh []uint32
+	for _, uid := range uids {
+		// "n:*" always returns the last message, even below n
+		if uid >= w.next {
+			fresh = append(fresh, uid)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	next := w.next
+	for _, uid := range fresh {
+		if uid >= next {
+			next = uid + 1
+		}
+	}
+	if seeding {
+		// the server did not report UIDNEXT, skip what is already there
+		w.next = next
+		return nil
+	}
+
+	candidates, err := w.r.fetchCandidates(c, w.box, fresh)
+	if err != nil {
+		return err
+	}
+	for _, m := range candidates {
+		w.rt.route(w, m)
+	}
+	w.next = next
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package mailreader
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func newTestWatcher(rt *Router) *watcher {
+	return &watcher{
+		rt:    rt,
+		r:     &ImapReader{},
+		box:   "INBOX",
+		done:  make(chan struct{}),
+		acked: make(chan struct{}, 1),
+	}
+}
+
+func TestRouteAcks(t *testing.T) {
+	tests := []struct {
+		name string
+		// sizes of the inboxes subscribed to the recipient, 0 drops
+		sizes []int
+		// acks lists the inboxes acking, in order
+		acks []int
+		// flagged tells whether the message is flagged after each ack
+		flagged []bool
+	}{
+		{"single", []int{1}, []int{0}, []bool{true}},
+		{"first of two", []int{1, 1}, []int{0, 1}, []bool{false, true}},
+		{"second of two", []int{1, 1}, []int{1, 0}, []bool{false, true}},
+		{"three", []int{1, 1, 1}, []int{2, 0, 1}, []bool{false, false, true}},
+		{"full inbox", []int{1, 0}, []int{0}, []bool{true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := NewRouter(RouterOptions{})
+			w := newTestWatcher(rt)
+
+			var inboxes []*VirtualInbox
+			for _, size := range tt.sizes {
+				inboxes = append(inboxes, rt.Subscribe("user@example.com", size))
+			}
+
+			rt.route(w, &imapCandidate{
+				uid:    42,
+				header: mail.Header{"To": {"User <user@example.com>"}},
+				mail:   &ImapMail{},
+			})
+
+			for i, in := range tt.acks {
+				var m *RoutedMail
+				select {
+				case m = <-inboxes[in].Messages():
+				default:
+					t.Fatalf("inbox %d got no message", in)
+				}
+				m.Ack()
+				// a second ack of the same copy does not count
+				m.Ack()
+
+				if got := len(w.acks) > 0; got != tt.flagged[i] {
+					t.Fatalf("after ack %d: flagged = %v, want %v", i, got, tt.flagged[i])
+				}
+			}
+			if len(w.acks) != 1 || w.acks[0] != 42 {
+				t.Errorf("acks = %v, want [42]", w.acks)
+			}
+		})
+	}
+}
+
+func TestAckDoesNotBlock(t *testing.T) {
+	rt := NewRouter(RouterOptions{})
+	w := newTestWatcher(rt)
+	in := rt.Subscribe("@example.com", 200)
+
+	// nothing drains acked, as while the watcher reconnects
+	for uid := uint32(1); uid <= 150; uid++ {
+		rt.route(w, &imapCandidate{
+			uid:    uid,
+			header: mail.Header{"To": {"a@example.com"}},
+			mail:   &ImapMail{},
+		})
+		(<-in.Messages()).Ack()
+	}
+
+	if len(w.acks) != 150 {
+		t.Errorf("queued %d acks, want 150", len(w.acks))
+	}
+}
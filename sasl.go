@@ -0,0 +1,75 @@
+package mailreader
+
+import (
+	"bytes"
+
+	"github.com/emersion/go-sasl"
+)
+
+// xoauth2Client implements the XOAUTH2 mechanism used by Google and Microsoft.
+type xoauth2Client struct {
+	user  string
+	token string
+}
+
+func newXOAuth2Client(user, token string) sasl.Client {
+	return &xoauth2Client{user: user, token: token}
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return string(AuthXOAuth2), []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the error challenge sent on failure with the empty response
+// the server expects before it reports the failure.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// loginClient implements LOGIN without an initial response, answering the
+// "Username:" challenge most POP3 servers send as well as "Password:".
+type loginClient struct {
+	user     string
+	password string
+}
+
+func newLoginClient(user, password string) sasl.Client {
+	return &loginClient{user: user, password: password}
+}
+
+func (a *loginClient) Start() (mech string, ir []byte, err error) {
+	return string(AuthLogin), nil, nil
+}
+
+func (a *loginClient) Next(challenge []byte) ([]byte, error) {
+	switch {
+	case bytes.EqualFold(challenge, []byte("Username:")):
+		return []byte(a.user), nil
+	case bytes.EqualFold(challenge, []byte("Password:")):
+		return []byte(a.password), nil
+	}
+
+	return nil, sasl.ErrUnexpectedServerChallenge
+}
+
+// deferredClient holds back the initial response of a SASL client until the
+// server asks for it, so a mechanism the server refuses is told apart from
+// refused credentials.
+type deferredClient struct {
+	sasl.Client
+	ir []byte
+}
+
+func (a *deferredClient) Start() (mech string, ir []byte, err error) {
+	mech, a.ir, err = a.Client.Start()
+	return mech, nil, err
+}
+
+func (a *deferredClient) Next(challenge []byte) ([]byte, error) {
+	if a.ir != nil {
+		ir := a.ir
+		a.ir = nil
+		return ir, nil
+	}
+	return a.Client.Next(challenge)
+}
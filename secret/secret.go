@@ -0,0 +1,72 @@
+// Package secret resolves credentials at the time a connection is made, so
+// they do not have to sit in configuration structs as plain strings.
+package secret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNotFound = errors.New("secret not found")
+)
+
+const redacted = "[redacted]"
+
+// Source hands out a secret, such as a password or a refresh token.
+type Source interface {
+	Secret(ctx context.Context) (string, error)
+}
+
+// Static is a secret known in advance. It never prints its value.
+type Static string
+
+func (s Static) Secret(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s Static) String() string {
+	return redacted
+}
+
+func (s Static) GoString() string {
+	return redacted
+}
+
+// Env reads the secret from the environment variable it names.
+type Env string
+
+func (e Env) Secret(ctx context.Context) (string, error) {
+	v, ok := os.LookupEnv(string(e))
+	if !ok {
+		return "", fmt.Errorf("%w: environment variable %s", ErrNotFound, string(e))
+	}
+	return v, nil
+}
+
+// File reads the secret from the file it names, such as a mounted secret.
+// The file is read again every time, so rotated secrets are picked up.
+// Trailing line breaks are dropped.
+type File string
+
+func (f File) Secret(ctx context.Context) (string, error) {
+	b, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: file %s", ErrNotFound, string(f))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Resolve returns the secret of src, or fallback when src is nil.
+func Resolve(ctx context.Context, src Source, fallback string) (string, error) {
+	if src == nil {
+		return fallback, nil
+	}
+	return src.Secret(ctx)
+}
@@ -0,0 +1,105 @@
+package mailreader
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// TLSOptions tunes how the certificate of the mail server is verified.
+// Certificates are verified against the system roots by default.
+type TLSOptions struct {
+	// RootCAs replaces the system roots when set.
+	RootCAs *x509.CertPool
+	// RootCAFiles lists PEM files whose certificates are trusted on top of
+	// RootCAs or the system roots.
+	RootCAFiles []string
+	// PinnedSPKI lists base64 encoded SHA-256 hashes of subject public key
+	// infos. When set, the verified certificate chain must contain one of
+	// them. Extra certificates the server sends do not count.
+	PinnedSPKI []string
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// DangerousInsecureSkipVerify accepts any certificate, leaving the mail
+	// readable by anyone on the path, proxies included. Only meant for local
+	// test servers. Pins are then only matched against the certificate of
+	// the server, as nothing else of the chain is verified.
+	DangerousInsecureSkipVerify bool
+}
+
+// tlsConfig builds the TLS configuration used to reach the server.
+func (c *ReaderConfig) tlsConfig() (*tls.Config, error) {
+	opts := c.TLS
+	if opts == nil {
+		opts = &TLSOptions{}
+	}
+
+	cfg := &tls.Config{
+		ServerName: string(c.Server),
+		MinVersion: opts.MinVersion,
+		RootCAs:    opts.RootCAs,
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	if len(opts.RootCAFiles) > 0 {
+		if cfg.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			cfg.RootCAs = pool
+		} else {
+			cfg.RootCAs = cfg.RootCAs.Clone()
+		}
+
+		for _, f := range opts.RootCAFiles {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %v", f)
+			}
+		}
+	}
+
+	if opts.DangerousInsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+
+	if len(opts.PinnedSPKI) > 0 {
+		pins := make(map[string]bool, len(opts.PinnedSPKI))
+		for _, p := range opts.PinnedSPKI {
+			pins[p] = true
+		}
+
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// the other certificates sent are not verified, anyone can
+			// send the pinned one along theirs
+			var certs []*x509.Certificate
+			for _, chain := range cs.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+			if opts.DangerousInsecureSkipVerify && len(cs.PeerCertificates) > 0 {
+				// the handshake only proves the server holds the leaf key
+				certs = cs.PeerCertificates[:1:1]
+			}
+
+			for _, cert := range certs {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+
+			return ErrCertificatePinMismatch
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,161 @@
+package mailreader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by parent, self-signed when
+// parent is nil.
+func newTestCert(t *testing.T, name string, ca bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func spkiPin(c *testCert) string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handshake connects a client configured by opts to a server sending chain,
+// the first certificate being its own.
+func handshake(t *testing.T, opts *TLSOptions, chain ...*testCert) error {
+	t.Helper()
+
+	cfg, err := (&ReaderConfig{Server: "mail.test", TLS: opts}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw [][]byte
+	for _, c := range chain {
+		raw = append(raw, c.cert.Raw)
+	}
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: raw, PrivateKey: chain[0].key}},
+	}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	go func() {
+		tls.Server(sc, server).Handshake()
+		sc.Close()
+	}()
+	return tls.Client(cc, cfg).Handshake()
+}
+
+func TestTLSPinning(t *testing.T) {
+	root := newTestCert(t, "root", true, nil)
+	leaf := newTestCert(t, "mail.test", false, root)
+	selfSigned := newTestCert(t, "mail.test", false, nil)
+	// a certificate the attacker does not hold the key of, but can send
+	pinned := newTestCert(t, "pinned", true, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	tests := []struct {
+		name  string
+		opts  *TLSOptions
+		chain []*testCert
+		err   error
+	}{
+		{
+			name:  "leaf pinned",
+			opts:  &TLSOptions{RootCAs: roots, PinnedSPKI: []string{spkiPin(leaf)}},
+			chain: []*testCert{leaf},
+		},
+		{
+			name:  "root pinned",
+			opts:  &TLSOptions{RootCAs: roots, PinnedSPKI: []string{spkiPin(root)}},
+			chain: []*testCert{leaf},
+		},
+		{
+			name:  "no pin matching",
+			opts:  &TLSOptions{RootCAs: roots, PinnedSPKI: []string{spkiPin(pinned)}},
+			chain: []*testCert{leaf},
+			err:   ErrCertificatePinMismatch,
+		},
+		{
+			name:  "pinned sent unverified",
+			opts:  &TLSOptions{RootCAs: roots, PinnedSPKI: []string{spkiPin(pinned)}},
+			chain: []*testCert{leaf, pinned},
+			err:   ErrCertificatePinMismatch,
+		},
+		{
+			name:  "insecure leaf pinned",
+			opts:  &TLSOptions{DangerousInsecureSkipVerify: true, PinnedSPKI: []string{spkiPin(selfSigned)}},
+			chain: []*testCert{selfSigned},
+		},
+		{
+			name:  "insecure pinned sent unverified",
+			opts:  &TLSOptions{DangerousInsecureSkipVerify: true, PinnedSPKI: []string{spkiPin(pinned)}},
+			chain: []*testCert{selfSigned, pinned},
+			err:   ErrCertificatePinMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, tt.opts, tt.chain...)
+			if tt.err == nil && err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("handshake error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
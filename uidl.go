@@ -0,0 +1,68 @@
+package mailreader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UidlSet holds the UIDLs of the POP3 messages already retrieved, with the
+// time each one was first seen.
+type UidlSet map[string]time.Time
+
+// UidlStore persists a UidlSet between runs.
+type UidlStore interface {
+	Load() (UidlSet, error)
+	Save(set UidlSet) error
+}
+
+// FileUidlStore keeps a UidlSet as JSON in a file.
+type FileUidlStore struct {
+	Path string
+}
+
+// Load returns an empty set when the file does not exist yet.
+func (s *FileUidlStore) Load() (UidlSet, error) {
+	set := make(UidlSet)
+
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// Save replaces the file atomically.
+func (s *FileUidlStore) Save(set UidlSet) error {
+	b, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.Path)
+}
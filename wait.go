@@ -0,0 +1,399 @@
+package mailreader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// MessagePredicate describes the message WaitForMessage is waiting for.
+// Zero fields are ignored, so the zero value matches any message.
+type MessagePredicate struct {
+	// From matches the address of the From or Sender header, case-insensitive.
+	From string
+	// Subject is matched against the message subject.
+	Subject *regexp.Regexp
+	// Body is matched against the content of every message part.
+	Body *regexp.Regexp
+	// Receiver matches any address the message was delivered to, see
+	// MessageRecipients.
+	Receiver string
+	// ReceiverRules tells how loosely Receiver is compared.
+	ReceiverRules RecipientRules
+	// After skips messages the server received before this time.
+	After time.Time
+	// Unseen skips messages already flagged as seen.
+	Unseen bool
+}
+
+type WaitOptions struct {
+	// Timeout bounds the whole wait; zero waits until ctx is done.
+	Timeout time.Duration
+	// PollInterval is the delay between two mailbox checks.
+	PollInterval time.Duration
+	// MarkSeen flags the returned message as seen on the server.
+	MarkSeen bool
+}
+
+func (o WaitOptions) interval() time.Duration {
+	if o.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return o.PollInterval
+}
+
+// matchHeader checks every criterion that only needs the message header.
+func (p *MessagePredicate) matchHeader(h mail.Header, date time.Time) bool {
+	if !p.After.IsZero() && date.Before(p.After) {
+		return false
+	}
+
+	if p.From != "" {
+		found := false
+		for _, key := range []string{"From", "Sender"} {
+			for _, a := range headerAddresses(h, key) {
+				if strings.EqualFold(a, p.From) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if p.Receiver != "" && !p.ReceiverRules.Match(h, p.Receiver) {
+		return false
+	}
+
+	if p.Subject != nil && !p.Subject.MatchString(decodeHeader(h.Get("Subject"), contentCharset(h))) {
+		return false
+	}
+
+	return true
+}
+
+// matchBody checks the body criterion against the decoded parts.
+func (p *MessagePredicate) matchBody(bodies []string) bool {
+	if p.Body == nil {
+		return true
+	}
+
+	for _, b := range bodies {
+		if p.Body.MatchString(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerAddresses returns the bare addresses listed in the header key.
+func headerAddresses(h mail.Header, key string) []string {
+	var addrs []string
+	for _, v := range h[key] {
+		addrs = append(addrs, bareAddresses(v)...)
+	}
+	return addrs
+}
+
+// bareAddresses returns the addresses of the address list v.
+func bareAddresses(v string) []string {
+	list, err := addressParser.ParseList(v)
+	if err != nil {
+		// keep something comparable for malformed headers
+		if v = strings.Trim(strings.TrimSpace(v), "<>"); v != "" {
+			return []string{v}
+		}
+		return nil
+	}
+
+	var addrs []string
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+// waitErr converts the reason a wait context ended into the error returned to callers.
+func waitErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrWaitTimeout
+	}
+	return ctx.Err()
+}
+
+// imapCandidate is a fetched message together with its raw header.
+type imapCandidate struct {
+	uid    uint32
+	date   time.Time
+	header mail.Header
+	mail   *ImapMail
+}
+
+// WaitForMessage polls box until a message matching pred shows up and stores
+// it as JSON into res. Messages arriving while waiting are considered too.
+// It returns ErrWaitTimeout once opts.Timeout or the deadline of ctx passes.
+func (r *ImapReader) WaitForMessage(ctx context.Context, res *[]byte, box string, pred MessagePredicate, opts WaitOptions) error {
+	if !r.hasRoute() {
+		return ErrNoProxy
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	c, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	r.log(fmt.Sprintf("Selecting box: %v", box))
+	if _, err = c.Select(box, false); err != nil {
+		return err
+	}
+
+	checked := make(map[uint32]bool)
+	for {
+		m, err := r.findMatch(c, box, &pred, checked)
+		if err != nil {
+			return err
+		}
+
+		if m != nil {
+			b, err := json.Marshal(m.mail)
+			if err != nil {
+				return err
+			}
+			*res = b
+
+			if opts.MarkSeen {
+				if err := markSeen(c, m.uid); err != nil {
+					r.warn(fmt.Sprintf("Warn: marking mail seen error %v", err))
+				}
+			}
+
+			return nil
+		}
+
+		timer := time.NewTimer(opts.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waitErr(ctx)
+		case <-timer.C:
+		}
+	}
+}
+
+// findMatch looks at the messages of the selected box not checked yet and
+// returns the most recent one matching pred, or nil.
+func (r *ImapReader) findMatch(c *client.Client, box string, pred *MessagePredicate, checked map[uint32]bool) (*imapCandidate, error) {
+	// NOOP lets the server report messages delivered since the last poll
+	if err := c.Noop(); err != nil {
+		return nil, err
+	}
+
+	cr := imap.NewSearchCriteria()
+	if !pred.After.IsZero() {
+		// SINCE has a one day granularity, the exact time is checked later
+		cr.Since = pred.After
+	}
+	if pred.Unseen {
+		cr.WithoutFlags = []string{imap.SeenFlag}
+	}
+
+	uids, err := c.UidSearch(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh []uint32
+	for _, uid := range uids {
+		if !checked[uid] {
+			fresh = append(fresh, uid)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil, nil
+	}
+	r.log(fmt.Sprintf("Checking %d new messages", len(fresh)))
+
+	// the bodies are only fetched for the headers matching
+	headers, err := r.fetchHeaders(c, fresh)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []uint32
+	for _, m := range headers {
+		checked[m.uid] = true
+		if pred.matchHeader(m.header, m.date) {
+			matching = append(matching, m.uid)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, nil
+	}
+
+	candidates, err := r.fetchCandidates(c, box, matching)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *imapCandidate
+	for _, m := range candidates {
+		var bodies []string
+		for _, p := range m.mail.Parts {
+			bodies = append(bodies, p.Content)
+		}
+		if !pred.matchBody(bodies) {
+			continue
+		}
+
+		if best == nil || best.date.Before(m.date) {
+			best = m
+		}
+	}
+
+	return best, nil
+}
+
+// fetchHeaders fetches the header and arrival date of the given uids, mail
+// left nil.
+func (r *ImapReader) fetchHeaders(c *client.Client, uids []uint32) ([]*imapCandidate, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, headerSection.FetchItem()}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+
+	var headers []*imapCandidate
+	for msg := range messages {
+		literal := msg.GetBody(headerSection)
+		if literal == nil || msg.Envelope == nil {
+			r.warn(fmt.Sprintf("Warn: server returned no header for uid %d", msg.Uid))
+			continue
+		}
+
+		m, err := readMessage(literal, r.limits().MaxHeaderSize)
+		if err != nil && !errors.Is(err, ErrHeaderTooLarge) {
+			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
+			continue
+		}
+
+		headers = append(headers, &imapCandidate{
+			uid:    msg.Uid,
+			date:   arrival(msg),
+			header: m.Header,
+		})
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return headers, nil
+}
+
+// arrival returns when the server received msg, the date it was sent when
+// the server did not tell.
+func arrival(msg *imap.Message) time.Time {
+	if msg.InternalDate.IsZero() {
+		return msg.Envelope.Date
+	}
+	return msg.InternalDate
+}
+
+// fetchCandidates fetches the given uids without setting the seen flag.
+func (r *ImapReader) fetchCandidates(c *client.Client, box string, uids []uint32) ([]*imapCandidate, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, section.FetchItem()}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.fetchLimited(c, true, seqset, items, messages)
+	}()
+
+	var candidates []*imapCandidate
+	for msg := range messages {
+		literal := msg.GetBody(section)
+		if literal == nil {
+			// over MaxMessageSize
+			literal = msg.GetBody(headerSection)
+		}
+		if literal == nil || msg.Envelope == nil {
+			r.warn(fmt.Sprintf("Warn: server returned no body for uid %d", msg.Uid))
+			continue
+		}
+
+		raw, err := io.ReadAll(literal)
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
+			continue
+		}
+
+		m, err := readMessage(bytes.NewReader(raw), r.limits().MaxHeaderSize)
+		if err != nil && !errors.Is(err, ErrHeaderTooLarge) {
+			r.warn(fmt.Sprintf("Warn: reading message error %v", err))
+			continue
+		}
+
+		msg.Body = map[*imap.BodySectionName]imap.Literal{section: bytes.NewBuffer(raw)}
+		ml, err := r.parseMsg(msg)
+		if err != nil {
+			r.warn(fmt.Sprintf("Warn: parsing message error %v", err))
+			continue
+		}
+		ml.Box = box
+		ml.ScanMethod = "IMAP"
+		ml.ScantAt = time.Now()
+		ml.Email = r.User
+
+		candidates = append(candidates, &imapCandidate{
+			uid:    msg.Uid,
+			date:   arrival(msg),
+			header: m.Header,
+			mail:   ml,
+		})
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+func markSeen(c *client.Client, uids ...uint32) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.SeenFlag}
+	return c.UidStore(seqset, item, flags, nil)
+}